@@ -2,79 +2,774 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 )
 
+// debugLogging is on when a log file is configured
+var debugLogging bool
+
 func main() {
-	// Read configuration
-	configuration := readConfiguration()
-	debugLogging := false
+	// Subcommands that don't connect anywhere
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "schema":
+			printSchema()
+			return
+		}
+	}
+
+	// How failures are reported, for wrapper scripts
+	switch output := getFlagValue(os.Args[1:], "--output"); output {
+	case "", "text":
+	case "json":
+		jsonOutput = true
+	default:
+		fatal(errConfig, fmt.Sprintf("Unknown --output %s, expected text or json", output), nil)
+	}
+
+	// Read configuration. On a terminal, without a profile or host given, the
+	// profile can be picked from a menu. A GUI starting the engine has none.
+	offerProfiles := isTerminal() && getFlagValue(os.Args[1:], "--host") == "" && getFlagValue(os.Args[1:], "--hosts-from") == ""
+	configuration := readConfiguration(getFlagValue(os.Args[1:], "--profile"), offerProfiles)
+
+	if configuration.QuietExit {
+		fatalExitStatus = 255
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if !runDoctor(configuration) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if host := getFlagValue(os.Args[1:], "--host"); host != "" {
+		applyHostFlag(&configuration, host)
+	}
+
+	if file := getFlagValue(os.Args[1:], "--command-file"); file != "" {
+		configuration.CommandFile = file
+		checkCommandFile(configuration)
+	}
 
-	// Setup logging if a log file name was passed in
-	if configuration.LogFileName != "" {
-		file, err := os.OpenFile("engine.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "show" {
+		if err := printConfiguration(configuration); err != nil {
+			fatal(errLocal, "Failed to print the configuration", err)
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "export-ssh" {
+		alias := getFlagValue(os.Args[1:], "--profile")
+		if alias == "" {
+			alias = "ssh-engine"
+		}
+		if err := writeSshConfigHost(os.Stdout, alias, configuration); err != nil {
+			fatal(errConfig, "Failed to export the configuration", err)
+		}
+		return
+	}
+
+	// Run against every host of the list, each in a process of its own
+	if source := getFlagValue(os.Args[1:], "--hosts-from"); source != "" {
+		hosts, err := readHostList(source)
+		if err != nil {
+			fatal(errLocal, "Failed to read the hosts", err)
+		}
+		failed, err := runHostsFrom(hosts, os.Args[1:], configuration)
+		if err != nil {
+			fatal(errLocal, "Failed to run the hosts", err)
+		}
+		if len(failed) > 0 {
+			fatal(errRemoteExit, fmt.Sprintf("%d of %d hosts failed", len(failed), len(hosts)), fmt.Errorf("%s", strings.Join(failed, ", ")))
+		}
+		return
+	}
+
+	// The log goes to syslog when asked to, with the input and output only
+	// when syslogOutput says so. Where there is no syslog, the log file or
+	// stderr does.
+	useSyslog := false
+	if configuration.LogTarget == "syslog" {
+		writer, err := openSyslog(configuration.SyslogFacility, configuration.SyslogTag)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Failed to open syslog, logging to the log file or stderr instead: %s", err)
+		} else {
+			defer writer.Close()
+			log.SetOutput(writer)
+			// syslog has timestamps of its own
+			log.SetFlags(0)
+			debugLogging = configuration.SyslogOutput
+			useSyslog = true
+		}
+	}
+
+	// Setup logging if a log file name was passed in. Without the file the
+	// log goes to stderr, which is no reason not to connect.
+	if configuration.LogFileName != "" && !useSyslog {
+		file, err := os.OpenFile(configuration.LogFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Printf("Failed to open the log file, logging to stderr instead: %s", err)
+		} else {
+			defer file.Close()
+			log.SetOutput(file)
+			atExit(func() { file.Sync() })
 		}
-		defer file.Close()
-		log.SetOutput(file)
 
 		debugLogging = true
 	}
+	traceLogging = configuration.TraceSsh
 
-	server := fmt.Sprintf("%s:%s", configuration.Host, configuration.Port)
+	// Run the local pre-command, the connection is not attempted if it fails
+	if configuration.PreCommand != "" {
+		if err := runLocalCommand(configuration.PreCommand); err != nil {
+			fatal(errLocal, "Pre-command failed", err)
+		}
+	}
+
+	servers := getServerAddresses(configuration)
 
 	// Setup the client configuration
 	sshConfig, err := getSshConfig(configuration)
 	if err != nil {
-		log.Fatalf("Failed to get SSH configuration: %s", err)
+		fatal(errConfig, "Failed to get SSH configuration", err)
 	}
 
 	// Start the connection
-	client, err := ssh.Dial("tcp", server, sshConfig)
+	// The kernel notices dead connections on its own too, through NAT and
+	// all, with TCP keepalives. Negative turns them off.
+	dialer := &net.Dialer{
+		Timeout:   sshConfig.Timeout,
+		KeepAlive: time.Duration(configuration.TcpKeepAlive) * time.Second,
+	}
+
+	connect := func() (*ssh.Client, error) {
+		if configuration.WebsocketURL != "" {
+			return dialWebSocket(configuration.WebsocketURL, dialer, sshConfig)
+		}
+		if configuration.RaceHosts && len(servers) > 1 {
+			return raceDial(servers, dialer, sshConfig)
+		}
+		return dial(servers, dialer, sshConfig)
+	}
+	client, err := connect()
+	// The agent may hold more keys than the server lets us try before the
+	// configured one gets its turn
+	if err != nil && configuration.RetryWithIdentitiesOnly && isTooManyAuthFailures(err) && canRetryWithIdentitiesOnly(configuration) {
+		log.Printf("The server closed the connection after too many authentication failures, retrying with identitiesOnly, only the configured key")
+		configuration.IdentitiesOnly = true
+		sshConfig, err = getSshConfig(configuration)
+		if err != nil {
+			fatal(errConfig, "Failed to get SSH configuration", err)
+		}
+		client, err = connect()
+	}
 	if err != nil {
-		log.Fatalf("Could not connect to SSH (failed to dial): %s", err)
+		fatal(getDialErrorCategory(err), "Could not connect to SSH (failed to dial)", err)
+	}
+	// A reconnect replaces the client
+	defer func() { client.Close() }()
+
+	// The host key can't tell when DNS or a load balancer sent us to another
+	// host with the same key, the host itself can
+	if configuration.ExpectedHostname != "" {
+		if err := checkHostname(client, configuration.ExpectedHostname); err != nil {
+			fatal(errAuth, "Connected to the wrong host", err)
+		}
+	}
+
+	// Facts are a nice to have, a host that can't tell is still used
+	var facts *remoteFacts
+	if configuration.GatherFacts {
+		facts, err = gatherFacts(client)
+		if err != nil {
+			log.Printf("Could not gather facts about the remote host: %s", err)
+		} else {
+			log.Println(facts)
+		}
+	}
+
+	// Without it the output is only noisier, which isn't worth stopping for
+	if configuration.SuppressMotd {
+		if err := hushLogin(client); err != nil {
+			log.Printf("Could not suppress the message of the day: %s", err)
+		}
+	}
+
+	if configuration.ServerAliveInterval > 0 {
+		go keepAlive(client, time.Duration(configuration.ServerAliveInterval)*time.Second, configuration.ServerAliveCountMax)
+	}
+	// As a ProxyCommand stdin and stdout carry the connection of the other
+	// client, to the server's own SSH port unless a host:port is given
+	if len(os.Args) > 1 && os.Args[1] == "proxy-stdio" {
+		target := net.JoinHostPort("localhost", configuration.Port)
+		if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+			target = os.Args[2]
+		}
+		if err := runProxyStdio(client, target); err != nil {
+			fatal(errNetwork, "Proxy stopped", err)
+		}
+		return
+	}
+
+	var localAddresses, remoteAddresses []string
+	for _, spec := range configuration.LocalForwards {
+		address, err := startLocalForward(client, spec)
+		if err != nil {
+			fatal(errLocal, "Failed to set up the local forward", err)
+		}
+		localAddresses = append(localAddresses, address)
+	}
+	for _, spec := range configuration.RemoteForwards {
+		address, err := startRemoteForward(client, spec)
+		if err != nil {
+			fatal(errNetwork, "Failed to set up the remote forward", err)
+		}
+		remoteAddresses = append(remoteAddresses, address)
+	}
+
+	// Like OpenSSH's LocalCommand, run once the connection and the forwards
+	// are up. It is a convenience, so a failure doesn't stop the run.
+	if configuration.LocalCommand != "" {
+		if err := runLocalCommand(configuration.LocalCommand, getForwardEnv(localAddresses, remoteAddresses)...); err != nil {
+			log.Printf("Local command failed: %s", err)
+		}
+	}
+
+	if err := runTransfers(client, configuration); err != nil {
+		fatal(errNetwork, "Failed to transfer the files", err)
+	}
+
+	// A daemon only holds the forwards open, there is no session to run
+	if configuration.Daemon {
+		if err := runDaemon(client, configuration); err != nil {
+			fatal(errNetwork, "Daemon stopped", err)
+		}
+		return
+	}
+
+	// A failed command is run again in a new session, but only when its
+	// output shows the failure is one worth retrying
+	var retryMatch *regexp.Regexp
+	if configuration.RetryOnOutputMatch != "" {
+		retryMatch, err = regexp.Compile(configuration.RetryOnOutputMatch)
+		if err != nil {
+			fatal(errConfig, "Failed to compile retryOnOutputMatch", err)
+		}
+	}
+
+	// A health check fails the run when the output isn't what it should be
+	var expectMatch *regexp.Regexp
+	if configuration.ExpectOutput != "" {
+		expectMatch, err = regexp.Compile(configuration.ExpectOutput)
+		if err != nil {
+			fatal(errConfig, "Failed to compile expectOutput", err)
+		}
+	}
+
+	var exitCode int
+	var failure *engineError
+	var output *tailBuffer
+	// A lost connection only gets a fresh shell when there is a terminal to
+	// hand it to, the input of a program can't pick up where it was
+	autoReconnect := configuration.AutoReconnect && isTerminal()
+	for attempt := 0; ; attempt++ {
+		if expectMatch != nil {
+			output = newTailBuffer(maxExpectedOutput)
+		} else if retryMatch != nil {
+			output = newTailBuffer(maxLineLength)
+		}
+		exitCode, failure = runSession(client, configuration, sessionStreams{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, output)
+		if failure != nil && autoReconnect && isConnectionLost(client) {
+			client.Close()
+			log.Printf("Connection lost, reconnecting: %s", failure)
+			reconnected, err := reconnect(connect, configuration.ReconnectAttempts, time.Duration(configuration.RetryDeadline)*time.Second)
+			if err != nil {
+				log.Printf("Could not reconnect: %s", err)
+				break
+			}
+			client = reconnected
+			atomic.StoreInt32(&serverUnresponsive, 0)
+			if configuration.ServerAliveInterval > 0 {
+				go keepAlive(client, time.Duration(configuration.ServerAliveInterval)*time.Second, configuration.ServerAliveCountMax)
+			}
+			fmt.Fprintln(os.Stderr, "Reconnected, in a fresh shell")
+			continue
+		}
+		if failure != nil || exitCode == 0 || retryMatch == nil || attempt >= configuration.RetryCount || !retryMatch.Match(output.Bytes()) {
+			break
+		}
+		log.Printf("Remote command failed with exit code %d and its output matches retryOnOutputMatch, retrying (%d of %d)", exitCode, attempt+1, configuration.RetryCount)
+	}
+
+	outputMismatch := expectMatch != nil && failure == nil && !expectMatch.Match(output.Bytes())
+
+	if configuration.PostCommand != "" {
+		env := []string{fmt.Sprintf("SSH_ENGINE_EXIT_CODE=%d", exitCode)}
+		if facts != nil {
+			env = append(env, facts.env()...)
+		}
+		if err := runLocalCommand(configuration.PostCommand, env...); err != nil {
+			log.Printf("Post-command failed: %s", err)
+		}
 	}
-	defer client.Close()
 
+	// A probe goes by the exit status alone, which is the remote one
+	if configuration.QuietExit {
+		if failure != nil {
+			fatal(failure.category, failure.message, failure.err)
+		}
+		if outputMismatch {
+			fatal(errRemoteExit, fmt.Sprintf("The output doesn't match expectOutput '%s'", configuration.ExpectOutput), nil)
+		}
+		runExitHooks()
+		os.Exit(exitCode)
+	}
+
+	// The text output has logged all of this already, and a failed remote
+	// command is no failure of the engine there
+	if jsonOutput {
+		if failure != nil {
+			fatal(failure.category, failure.message, failure.err)
+		}
+		if exitCode != 0 {
+			fatal(errRemoteExit, fmt.Sprintf("Remote command exited with status %d", exitCode), nil)
+		}
+	}
+	if outputMismatch {
+		fatal(errRemoteExit, fmt.Sprintf("The output doesn't match expectOutput '%s'", configuration.ExpectOutput), nil)
+	}
+}
+
+// sessionStreams are the local ends of a session: where its input comes
+// from, unless a command file or pipe or the terminal has it, and where its
+// output goes
+type sessionStreams struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// runSession runs the remote command, or the shell, in a new session and
+// returns its exit code. The output is also copied to output when it is set.
+// When the session was cut short, the reason is returned as well.
+func runSession(client *ssh.Client, configuration Configurations, streams sessionStreams, output *tailBuffer) (int, *engineError) {
 	// Start a session
 	session, err := client.NewSession()
 	if err != nil {
-		log.Fatalf("Failed to create SSH session: %s", err)
+		fatal(errNetwork, "Failed to create SSH session", err)
 	}
 	defer session.Close()
 
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
+	// Whatever closes the session early leaves the reason here. The remote
+	// gets exitGrace to finish what it is writing, once its input is closed.
+	failures := make(chan *engineError, 1)
+	var stdin io.WriteCloser
+	cutShort := func(category error, message string) {
+		log.Printf("%s, closing the session", message)
+		select {
+		case failures <- &engineError{category: category, message: message}:
+		default:
+		}
+		if configuration.ExitGrace > 0 && stdin != nil {
+			stdin.Close()
+			time.AfterFunc(time.Duration(configuration.ExitGrace)*time.Second, func() {
+				session.Close()
+			})
+			return
+		}
+		session.Close()
+	}
+
+	// From here on the server refuses to open any more sessions, should the
+	// connection be taken over. Without a reply nothing else is waited for.
+	if configuration.NoMoreSessions {
+		if _, _, err := client.SendRequest("no-more-sessions@openssh.com", false, nil); err != nil {
+			fatal(errNetwork, "Failed to send no-more-sessions", err)
+		}
+	}
+
+	// Output is written through as it arrives, unless whole lines are wanted.
+	// Each stream keeps its order, merged or not.
+	stdout, stderr := streams.stdout, streams.stderr
+	if configuration.MergeStderr {
+		stderr = streams.stdout
+	}
+	if configuration.QuietExit {
+		stdout, stderr = ioutil.Discard, ioutil.Discard
+	}
+	if configuration.MaxOutputBytes > 0 {
+		limit := newOutputLimit(configuration.MaxOutputBytes)
+		stdout, stderr = limit.writer(stdout), limit.writer(stderr)
+	}
+	if configuration.TimestampOutput && configuration.MergeStderr {
+		// The streams share the lines of the output, so each only writes
+		// whole lines to it, one stream at a time
+		merged := &lockedWriter{w: newTimestampWriter(stdout, configuration.TimestampFormat)}
+		stdoutLines, stderrLines := newLineBuffer(merged), newLineBuffer(merged)
+		flush := func() {
+			stdoutLines.Flush()
+			stderrLines.Flush()
+		}
+		removeHook := atExit(flush)
+		defer func() {
+			flush()
+			removeHook()
+		}()
+		stdout, stderr = stdoutLines, stderrLines
+	} else if configuration.TimestampOutput {
+		stdout = newTimestampWriter(stdout, configuration.TimestampFormat)
+		stderr = newTimestampWriter(stderr, configuration.TimestampFormat)
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if configuration.OutputBuffering == "line" {
+		stdout, stderr := newLineBuffer(stdout), newLineBuffer(stderr)
+		flush := func() {
+			stdout.Flush()
+			stderr.Flush()
+		}
+		removeHook := atExit(flush)
+		defer func() {
+			flush()
+			removeHook()
+		}()
+		session.Stdout, session.Stderr = stdout, stderr
+	}
+	var echo *commandEcho
+	if configuration.EchoCommands {
+		echo = newCommandEcho(session.Stdout)
+		session.Stdout = echo
+	}
+	var marker *commandMarker
+	if configuration.CommandMarker != "" {
+		marker = newCommandMarker(session.Stdout, configuration.CommandMarker)
+		// The when clauses of a command file look at the output
+		marker.captureOutput = configuration.CommandResultsFile != "" || configuration.CommandFile != ""
+		session.Stdout = marker
+		session.Stderr = marker.stderr(session.Stderr)
+	}
+	if output != nil {
+		session.Stdout = io.MultiWriter(session.Stdout, output)
+		session.Stderr = io.MultiWriter(session.Stderr, output)
+	}
+	if debugLogging {
+		// Only the log is cut short, the output itself is passed on whole
+		limit := newLogLimit(configuration.MaxLogBytes)
+		defer limit.report()
+		stdout := newLineWriter(session.Stdout, func(line string) {
+			if line, ok := limit.cut(line); ok {
+				log.Println("Output: " + line)
+			}
+		})
+		stderr := newLineWriter(session.Stderr, func(line string) {
+			if line, ok := limit.cut(line); ok {
+				log.Println("Error output: " + line)
+			}
+		})
+		// A last line without a newline is only logged once the session is over
+		defer stdout.Flush()
+		defer stderr.Flush()
+		session.Stdout, session.Stderr = stdout, stderr
+	}
 
 	// StdinPipe for commands
-	stdin, _ := session.StdinPipe()
+	stdin, err = session.StdinPipe()
+	if err != nil {
+		fatal(errNetwork, "Failed to open the input of the session", err)
+	}
+	sender, err := newCommandSender(stdin, configuration.AllowedCommands)
+	if err != nil {
+		fatal(errConfig, "Failed to set up the allowed commands", err)
+	}
+	if configuration.AuditLogFile != "" {
+		audit, err := openAuditLog(configuration.AuditLogFile, client.RemoteAddr().String(), configuration.User, configuration.AuditHashChain)
+		if err != nil {
+			fatal(errLocal, "Failed to set up the audit log", err)
+		}
+		defer audit.Close()
+		sender.audit = audit
+	}
+	sender.marker = marker
+	sender.echo = echo
+	sender.newline = getLineEnding(configuration.LineEnding, string(client.ServerVersion()))
+
+	// Answer the prompts of the expect rules, whichever stream they show up on
+	var expect *expecter
+	if len(configuration.Expect) > 0 {
+		expect, err = newExpecter(configuration.Expect, sender.write)
+		if err != nil {
+			fatal(errConfig, "Failed to set up the expect rules", err)
+		}
+		session.Stdout = newWatchWriter(session.Stdout, expect)
+		session.Stderr = newWatchWriter(session.Stderr, expect)
+	}
 
-	// Start remote shell
-	if err := session.Shell(); err != nil {
-		log.Fatalf("Failed to start shell: %s", err)
+	// The sudo password goes to stdin as is, past the audit and debug logs
+	var sudo *sudoResponder
+	if configuration.SudoPassword != "" {
+		sudo = newSudoResponder(stdin, configuration.SudoPassword, sender.newline, time.Duration(configuration.SudoPromptTimeout)*time.Second, cutShort)
+		session.Stdout = newWatchWriter(session.Stdout, sudo)
+		session.Stderr = newWatchWriter(session.Stderr, sudo)
 	}
 
-	// Run the supplied command first
-	fmt.Fprintf(stdin, "%s\n", configuration.RemoteCommand)
+	if len(configuration.SendEnv) > 0 {
+		sendEnv(session, configuration.SendEnv)
+	}
 
+	// Staying in the shell after the command only makes sense on a terminal
+	interactive := configuration.InteractiveAfterCommand && isTerminal()
+	if interactive {
+		if err := requestPty(session, !configuration.SuppressEcho); err != nil {
+			fatal(errNetwork, "Failed to request a PTY", err)
+		}
+	}
+
+	// A shell that is still starting up may lose what is sent to it. Only
+	// a shell on a PTY shows a prompt.
+	var prompt *promptWatcher
+	if configuration.WaitForPrompt && interactive {
+		prompt, err = newPromptWatcher(configuration.PromptPattern)
+		if err != nil {
+			fatal(errConfig, "Failed to compile promptPattern", err)
+		}
+		session.Stdout = newWatchWriter(session.Stdout, prompt)
+		session.Stderr = newWatchWriter(session.Stderr, prompt)
+	}
+
+	if configuration.RemoteScriptFile != "" {
+		// A local script is run by bash on the remote, reading it from stdin
+		command, script, err := getRemoteScript(configuration)
+		if err != nil {
+			fatal(errLocal, "Failed to load the remote script", err)
+		}
+		if err := sender.record(command + " < " + configuration.RemoteScriptFile); err != nil {
+			fatal(errLocal, "Failed to record the remote script", err)
+		}
+		if err := session.Start(command); err != nil {
+			fatal(errNetwork, "Failed to start the remote script", err)
+		}
+		// A script that exits early doesn't read the rest
+		if _, err := stdin.Write(script); err != nil {
+			log.Printf("Remote session ended before the whole script was sent: %s", err)
+		}
+	} else if isDirectExec(configuration) {
+		// The command is the session's own, no shell reads it from stdin
+		command := configuration.RemoteCommand
+		if configuration.RemotePath != "" {
+			command = "export " + strings.TrimSpace(getRemotePathPrefix(configuration)) + "; " + command
+		}
+		if err := sender.start(session, configuration.RemoteCommand, command); errors.Is(err, errCommandNotAllowed) {
+			fatal(errConfig, "Failed to run the remote command", err)
+		} else if errors.Is(err, errAuditFailed) {
+			fatal(errLocal, "Stopping", err)
+		} else if err != nil {
+			fatal(errNetwork, "Failed to start the remote command", err)
+		}
+	} else {
+		// Start remote shell
+		if err := session.Shell(); err != nil {
+			fatal(errNetwork, "Failed to start shell", err)
+		}
+
+		if prompt != nil && !prompt.wait(time.Duration(configuration.PromptTimeout)*time.Second) {
+			log.Printf("No prompt within promptTimeout, sending anyway")
+		}
+
+		// The shell keeps the PATH for everything run in it after this
+		if configuration.RemotePath != "" {
+			if err := sender.write("export " + strings.TrimSpace(getRemotePathPrefix(configuration))); err != nil {
+				fatal(errNetwork, "Failed to set the remote PATH", err)
+			}
+		}
+
+		// Run the supplied command first, without one this is just a plain shell
+		if configuration.RemoteCommand != "" {
+			if err := sender.sendCommand(configuration.RemoteCommand, getShellCommand(configuration.RemoteCommand, string(client.ServerVersion()))); err != nil {
+				fatal(errNetwork, "Failed to send the remote command", err)
+			}
+		}
+	}
+
+	stopSignals, err := forwardSignals(session, configuration.ForwardSignals)
+	if err != nil {
+		fatal(errConfig, "Failed to forward signals", err)
+	}
+	defer stopSignals()
+
+	if sudo != nil {
+		sudo.start()
+	}
+	if expect != nil {
+		go expect.run(cutShort)
+	}
+
+	// The commands of a command file are read anew for every session, so a
+	// retry runs all of them again
+	var commands io.Reader
+	if configuration.CommandFile != "" {
+		commands, err = readCommandFile(configuration.CommandFile, configuration.CommandMarker != "")
+		if err != nil {
+			fatal(errLocal, "Failed to read the command file", err)
+		}
+		sender.conditional = configuration.CommandMarker != ""
+	}
+
+	var restoreTerminal func()
+	sessionDone := make(chan struct{})
+	if configuration.Exec {
+		// Nothing else is sent but the command file, the shell exits once
+		// the commands are done. The expect rules and sudo still need stdin
+		// to answer until they are done.
+		var answering []<-chan struct{}
+		if expect != nil {
+			answering = append(answering, expect.done)
+		}
+		if sudo != nil {
+			answering = append(answering, sudo.done)
+		}
+		go func() {
+			if commands != nil {
+				forwardInput(commands, sender, configuration)
+			}
+			for _, done := range answering {
+				<-done
+			}
+			stdin.Close()
+		}()
+	} else if interactive {
+		// Hand the local terminal over to the remote PTY as it is
+		restoreTerminal, err = makeTerminalRaw()
+		if err != nil {
+			fatal(errLocal, "Failed to set up the terminal", err)
+		}
+		var keys io.Writer = stdin
+		if configuration.EscapeChar != "none" {
+			var forwards []string
+			for _, spec := range configuration.LocalForwards {
+				forwards = append(forwards, "  local "+spec)
+			}
+			for _, spec := range configuration.RemoteForwards {
+				forwards = append(forwards, "  remote "+spec)
+			}
+			keys = newEscapeWriter(stdin, configuration.EscapeChar[0], forwards, func() {
+				session.Close()
+			})
+		}
+		go func() {
+			copyTerminalInput(keys, sessionDone)
+			stdin.Close()
+		}()
+	} else {
+		// Commands come from the chess GUI, the command file, or whoever writes
+		// to the pipe
+		input := streams.stdin
+		if commands != nil {
+			input = commands
+		} else if configuration.CommandPipe != "" {
+			input, err = newPipeReader(configuration.CommandPipe)
+			if err != nil {
+				fatal(errLocal, "Failed to open the command pipe", err)
+			}
+		}
+		go func() {
+			forwardInput(input, sender, configuration)
+			stdin.Close()
+		}()
+	}
+
+	// Input is forwarded on its own goroutine while the session copies the
+	// output on its own ones, so neither side can hold up the other. The
+	// session is over once the remote shell exits, even if the local side
+	// is still waiting for input.
+	exitCode := 0
+	var failure *engineError
+	err = session.Wait()
+	close(sessionDone)
+	if sudo != nil {
+		sudo.stop()
+	}
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitStatus()
+		} else if atomic.LoadInt32(&serverUnresponsive) != 0 {
+			log.Printf("No response from server, the connection was closed")
+			failure = &engineError{category: errTimeout, message: "No response from server", err: err}
+			exitCode = -1
+		} else {
+			log.Printf("Remote session ended with an error: %s", err)
+			failure = &engineError{category: errNetwork, message: "Remote session ended with an error", err: err}
+			exitCode = -1
+		}
+	}
+	if restoreTerminal != nil {
+		restoreTerminal()
+	}
+	if marker != nil {
+		marker.close()
+		if configuration.CommandTiming {
+			marker.printTimings(streams.stderr)
+		}
+		if configuration.CommandResultsFile != "" {
+			if err := marker.writeResults(configuration.CommandResultsFile); err != nil {
+				log.Printf("Failed to write the command results: %s", err)
+			}
+		}
+	}
+
+	select {
+	case failure = <-failures:
+	default:
+	}
+
+	return exitCode, failure
+}
+
+// isDirectExec tells whether remoteCommand is run as the command of the
+// session, which it is unless the session is interactive. The input, in
+// exec mode or not, then goes to the command itself. A command file or a
+// marker needs a shell to send them to.
+func isDirectExec(configuration Configurations) bool {
+	return configuration.DirectExec && configuration.RemoteScriptFile == "" && configuration.RemoteCommand != "" &&
+		!configuration.InteractiveAfterCommand && configuration.CommandFile == "" && configuration.CommandMarker == ""
+}
+
+// forwardInput sends the lines read from input to the remote shell until
+// input is closed or quit is sent.
+func forwardInput(input io.Reader, sender *commandSender, configuration Configurations) {
 	// Accepting commands
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(input)
+	// The buffer grows as needed, but a larger initial one would raise the
+	// limit to its size
+	size := bufio.MaxScanTokenSize
+	if configuration.MaxInputLine < size {
+		size = configuration.MaxInputLine
+	}
+	scanner.Buffer(make([]byte, 0, size), configuration.MaxInputLine)
 
 	for scanner.Scan() {
-		input := scanner.Text()
+		// Whatever the local line ending, the lines are sent with lineEnding
+		input := strings.TrimSuffix(scanner.Text(), "\r")
 
 		if debugLogging {
 			log.Println("Input: " + input)
 		}
-		
+
 		// Set threads and hash to override ChessBase
 		if configuration.Hash != "" {
 			if strings.Contains(scanner.Text(), "Hash") {
@@ -82,8 +777,11 @@ func main() {
 				if debugLogging {
 					log.Println("Overwriting Hash value with input: " + cmd)
 				}
-				fmt.Fprintf(stdin, "%s\n", cmd)
-				continue;
+				if err := sendInput(sender, cmd); err != nil {
+					logStoppedInput(err)
+					return
+				}
+				continue
 			}
 		}
 		if configuration.Threads != "" {
@@ -92,12 +790,18 @@ func main() {
 				if debugLogging {
 					log.Println("Overwriting Threads value with input: " + cmd)
 				}
-				fmt.Fprintf(stdin, "%s\n", cmd)
-				continue;
+				if err := sendInput(sender, cmd); err != nil {
+					logStoppedInput(err)
+					return
+				}
+				continue
 			}
 		}
 
-		fmt.Fprintf(stdin, "%s\n", input)
+		if err := sendInput(sender, input); err != nil {
+			logStoppedInput(err)
+			return
+		}
 		if input == "quit" {
 			if debugLogging {
 				log.Println("Quit sent")
@@ -105,75 +809,352 @@ func main() {
 			break
 		}
 	}
+
+	// The session ends either way, but not without saying why
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		log.Printf("Stopped reading input: a line is longer than maxInputLine (%d bytes)", configuration.MaxInputLine)
+	} else if err != nil {
+		log.Printf("Stopped reading input: %s", err)
+	}
 }
 
-func getSshConfig(configuration Configurations) (*ssh.ClientConfig, error) {
-	key, err := getKeyFile(configuration.PrivateKeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("could not read privateKeyFile at %s: %w", configuration.PrivateKeyFile, err)
+// logStoppedInput says why no more input is forwarded. The remote shell
+// exiting, after an exit say, is an ordinary end of the session.
+func logStoppedInput(err error) {
+	if errors.Is(err, errStdinClosed) {
+		log.Printf("Remote session ended, not sending any more input")
+		return
 	}
+	log.Printf("Stopped forwarding input: %s", err)
+}
 
-	sshConfig := &ssh.ClientConfig{
-		User: configuration.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// sendInput sends a line of input. Refused lines are reported, the session
+// carries on without them. Nothing may be run without being audited though.
+// Any other error means input can't be sent anymore.
+func sendInput(sender *commandSender, line string) error {
+	err := sender.send(line)
+	if errors.Is(err, errCommandNotAllowed) {
+		fmt.Fprintf(os.Stderr, "Not sent, %s\n", err)
+		return nil
+	} else if errors.Is(err, errAuditFailed) {
+		fatal(errLocal, "Stopping", err)
+	}
+	return err
+}
+
+// getServerAddresses returns the host followed by the fallback hosts. These
+// may carry their own port, otherwise the configured one is used.
+func getServerAddresses(configuration Configurations) []string {
+	addresses := []string{getServerAddress(configuration.Host, configuration.Port)}
+	for _, fallback := range configuration.FallbackHosts {
+		host, port, err := net.SplitHostPort(fallback)
+		if err != nil {
+			host, port = fallback, configuration.Port
+		}
+		addresses = append(addresses, getServerAddress(host, port))
 	}
 
-	return sshConfig, nil
+	return addresses
 }
 
-func getKeyFile(file string) (ssh.Signer, error) {
-	buf, err := ioutil.ReadFile(file)
+func getServerAddress(host string, port string) string {
+	// IPv6 literals may be given with or without brackets, JoinHostPort adds
+	// them back where needed
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
+// dial connects to the first address that can be reached. Only network
+// errors move on to the next address, a failed handshake or authentication
+// points to a configuration problem and is returned right away.
+func dial(addresses []string, dialer *net.Dialer, sshConfig *clientConfig) (*ssh.Client, error) {
+	var err error
+	for _, address := range addresses {
+		var conn net.Conn
+		conn, err = dialer.Dial("tcp", address)
+		if err != nil {
+			if len(addresses) > 1 {
+				log.Printf("Could not reach %s: %s", address, err)
+			}
+			continue
+		}
+
+		client, err := newClientFromConn(conn, address, sshConfig)
+		if err != nil {
+			return nil, err
+		}
+		if len(addresses) > 1 {
+			log.Printf("Connected to %s", address)
+		}
+
+		return client, nil
+	}
+
+	return nil, err
+}
+
+// raceDial connects to all the addresses at once and returns the client of
+// the first that authenticates. The connections still on their way are
+// given up, and the clients that make it after all closed. When none
+// succeeds, the error of the first address is returned, the others logged.
+func raceDial(addresses []string, dialer *net.Dialer, sshConfig *clientConfig) (*ssh.Client, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		index  int
+		client *ssh.Client
+		err    error
+	}
+	results := make(chan result, len(addresses))
+	for i, address := range addresses {
+		go func(i int, address string) {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err != nil {
+				results <- result{index: i, err: err}
+				return
+			}
+			client, err := newClientFromConn(conn, address, sshConfig)
+			results <- result{index: i, client: client, err: err}
+		}(i, address)
+	}
+
+	errs := make([]error, len(addresses))
+	for received := 1; received <= len(addresses); received++ {
+		r := <-results
+		if r.err != nil {
+			log.Printf("Could not connect to %s: %s", addresses[r.index], r.err)
+			errs[r.index] = r.err
+			continue
+		}
+
+		log.Printf("Connected to %s first", addresses[r.index])
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if loser := <-results; loser.client != nil {
+					loser.client.Close()
+				}
+			}
+		}(len(addresses) - received)
+		return r.client, nil
+	}
+
+	return nil, errs[0]
+}
+
+// newClientFromConn runs the SSH handshake over an established connection,
+// whatever transport it uses. The connection is closed if the handshake
+// fails. Like any ssh.Client, the client may open sessions from several
+// goroutines at once.
+func newClientFromConn(conn net.Conn, address string, sshConfig *clientConfig) (*ssh.Client, error) {
+	// Keep track of what the handshake settles on, for the logs
+	info := &connectionInfo{address: address, fingerprintHash: sshConfig.fingerprintHash}
+	kexConn := &kexInitConn{Conn: conn}
+	config := *sshConfig.ClientConfig
+	if len(config.HostKeyAlgorithms) == 0 && sshConfig.hostKeyAlgorithms != nil {
+		config.HostKeyAlgorithms = sshConfig.hostKeyAlgorithms(address)
+	}
+	if sshConfig.hostAuthMethods != nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		auth, err := sshConfig.hostAuthMethods(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config.Auth = auth
+	}
+	kexTraced := false
+	// The ssh package only keeps the text of the error of the callback, so
+	// it is kept here to tell a rejected host key
+	var hostKeyErr error
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// Both sides have sent their KEXINIT by now, and authentication
+		// is yet to come
+		traceKexInit(kexConn)
+		kexTraced = true
+		info.hostKey = key
+		hostKeyErr = sshConfig.HostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+
+	kexConn.startBannerTimeout(sshConfig.bannerTimeout)
+	c, chans, reqs, err := ssh.NewClientConn(kexConn, address, &config)
 	if err != nil {
-		return nil, fmt.Errorf("error reading the key file: %w", err)
+		if !kexTraced {
+			traceKexInit(kexConn)
+		}
+		conn.Close()
+		if kexConn.bannerTimedOut() {
+			return nil, fmt.Errorf("%w within bannerTimeout (%s), the TCP connection to %s was accepted: %v", errBannerTimeout, sshConfig.bannerTimeout, address, err)
+		}
+		if hostKeyErr != nil {
+			return nil, fmt.Errorf("ssh: handshake failed: %w", hostKeyErr)
+		}
+		return nil, err
 	}
 
-	key, err := ssh.ParsePrivateKey(buf)
+	if debugLogging {
+		info.serverVersion = string(c.ServerVersion())
+		info.client = kexConn.client.get()
+		info.server = kexConn.server.get()
+		log.Println(info)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+const (
+	minRekeyThreshold = 1 << 20
+	maxRekeyThreshold = 1 << 36
+)
+
+// clientConfig is the configuration of the SSH client, with what the engine
+// adds to the handshake
+type clientConfig struct {
+	*ssh.ClientConfig
+	// hostKeyAlgorithms returns the host key algorithms to ask the server at
+	// address for, when HostKeyAlgorithms isn't set. It may be nil.
+	hostKeyAlgorithms func(address string) []string
+	// fingerprintHash formats the host key in the logs
+	fingerprintHash string
+	// bannerTimeout bounds the wait for the version line of the server
+	bannerTimeout time.Duration
+	// hostAuthMethods returns the authentication methods for the host
+	// dialed, as a Kerberos ticket is for one host only. It may be nil,
+	// leaving Auth as it is.
+	hostAuthMethods func(host string) ([]ssh.AuthMethod, error)
+}
+
+func getSshConfig(configuration Configurations) (*clientConfig, error) {
+	authMethods, err := getAuthMethods(configuration)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing the private key file. Is this a valid private key?: %w", err)
+		return nil, err
 	}
 
-	return key, nil
+	callback, algorithms := getHostKeyCallback(configuration)
+	sshConfig := &clientConfig{
+		ClientConfig: &ssh.ClientConfig{
+			User:            configuration.User,
+			Auth:            authMethods,
+			HostKeyCallback: callback,
+		},
+		hostKeyAlgorithms: algorithms,
+		fingerprintHash:   configuration.FingerprintHash,
+		bannerTimeout:     time.Duration(configuration.BannerTimeout) * time.Second,
+	}
+	if usesKerberos(configuration) {
+		sshConfig.hostAuthMethods = func(host string) ([]ssh.AuthMethod, error) {
+			if host == strings.TrimSuffix(strings.TrimPrefix(configuration.Host, "["), "]") {
+				return authMethods, nil
+			}
+			configuration := configuration
+			configuration.Host = host
+			return getAuthMethods(configuration)
+		}
+	}
+	if err := applySshSettings(sshConfig.ClientConfig, configuration); err != nil {
+		return nil, err
+	}
+
+	return sshConfig, nil
 }
 
-func readConfiguration() Configurations {
-	if _, err := os.Stat("engine.yml"); os.IsNotExist(err) {
-		fmt.Println("The file 'engine.yml' could not be found in the current directory")
-		os.Exit(1)
+// applySshSettings sets rekeyThreshold and the options on the client
+// configuration
+func applySshSettings(sshConfig *ssh.ClientConfig, configuration Configurations) error {
+	// Rekeying under a MiB is all handshake, and RFC 4344 advises rekeying
+	// block ciphers at least every 2^32 blocks (64 GiB)
+	if threshold := configuration.RekeyThreshold; threshold != 0 {
+		if threshold < minRekeyThreshold || threshold > maxRekeyThreshold {
+			return fmt.Errorf("rekeyThreshold must be between %d and %d bytes", uint64(minRekeyThreshold), uint64(maxRekeyThreshold))
+		}
+		sshConfig.RekeyThreshold = threshold
 	}
 
-	viper.SetConfigName("engine")
-	viper.SetConfigType("yml")
-	viper.AddConfigPath(".")
+	return applySshOptions(sshConfig, configuration.Options)
+}
 
-	// Read the configuration
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			fmt.Println("No such config file")
-		} else {
-			fmt.Printf("Error reading the engine.yml file: %s", err)
+// getFingerprint formats the fingerprint of the key the way fingerprintHash
+// asks for. md5 is for servers whose keys are published in the old format.
+func getFingerprint(key ssh.PublicKey, hash string) string {
+	if hash == "md5" {
+		return "MD5:" + ssh.FingerprintLegacyMD5(key)
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// errHostKeyVerifierRejected is a host key hostKeyVerifierCommand didn't
+// trust
+var errHostKeyVerifierRejected = errors.New("host key rejected by hostKeyVerifierCommand")
+
+// getHostKeyCallback returns the host key check, and with known_hosts the
+// host key algorithms to ask each server for
+func getHostKeyCallback(configuration Configurations) (ssh.HostKeyCallback, func(address string) []string) {
+	if configuration.HostKeyVerifierCommand == "" {
+		if configuration.StrictHostKeyChecking == "no" {
+			return ssh.InsecureIgnoreHostKey(), nil
+		}
+		callback, algorithms := getKnownHostsCallback(configuration)
+		if configuration.VerifySshfp {
+			callback = getSshfpCallback(configuration, callback)
+		}
+		return callback, algorithms
+	}
+
+	// Delegate the trust decision to an external program. It is invoked with
+	// the host, the key type and the fingerprint, and a zero exit status
+	// means the key is trusted.
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := getFingerprint(key, configuration.FingerprintHash)
+		cmd := exec.Command(configuration.HostKeyVerifierCommand, hostname, key.Type(), fingerprint)
+		// Stdout is the engine protocol channel, so keep the verifier off it
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%w: %s for %s, %s", errHostKeyVerifierRejected, fingerprint, hostname, err)
 		}
-		os.Exit(1)
+		return nil
+	}, nil
+}
+
+// checkKeyFilePermissions reports a key file that others than its owner can
+// read or write, which OpenSSH refuses to use. Windows has no such modes.
+func checkKeyFilePermissions(file string) error {
+	if runtime.GOOS == "windows" {
+		return nil
 	}
 
-	var configuration Configurations
-	if err := viper.Unmarshal(&configuration); err != nil {
-		fmt.Printf("Unable to decode the engine.yml file: %v", err)
-		os.Exit(1)
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permissions %04o for %s are too open, it should only be accessible by its owner (chmod 600)", perm, file)
 	}
 
-	return configuration
+	return nil
 }
 
-type Configurations struct {
-	User           string `mapstructure:"user"`
-	PrivateKeyFile string `mapstructure:"privateKeyFile"`
-	Host           string `mapstructure:"host"`
-	Port           string `mapstructure:"port"`
-	RemoteCommand  string `mapstructure:"remoteCommand"`
-	Hash           string `mapstructure:"hash"`
-	Threads        string `mapstructure:"threads"`
-	LogFileName    string `mapstructure:"logFileName"`
+func getKeyFile(file string, passphrase string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the key file: %w", err)
+	}
+
+	if isPuttyKey(buf) {
+		key, err := parsePuttyKey(buf, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the PuTTY key file: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err := parsePrivateKey(file, buf, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the private key file: %w", err)
+	}
+
+	return key, nil
 }
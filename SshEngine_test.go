@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// copyKeyFile puts the key where only its owner can read it, as git doesn't
+// keep the permissions of the testdata
+func copyKeyFile(t *testing.T, name string) string {
+	t.Helper()
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "keys", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeKeyFile(t, buf)
+}
+
+func writeKeyFile(t *testing.T, buf []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(file, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestGetSshConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyFile    func(t *testing.T) string
+		passphrase string
+		publicKey  string
+		wantErr    error
+		wantMsg    string
+	}{
+		{
+			name:    "missing key file",
+			keyFile: func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing") },
+			wantErr: os.ErrNotExist,
+			wantMsg: "error reading the key file",
+		},
+		{
+			name:    "garbage key",
+			keyFile: func(t *testing.T) string { return writeKeyFile(t, []byte("not a key\n")) },
+			wantMsg: "no private key found",
+		},
+		{
+			name:      "valid key",
+			keyFile:   func(t *testing.T) string { return copyKeyFile(t, "ed25519-openssh") },
+			publicKey: "ed25519-openssh.pub",
+		},
+		{
+			name:    "encrypted key without passphrase",
+			keyFile: func(t *testing.T) string { return copyKeyFile(t, "ed25519-openssh-encrypted") },
+			wantMsg: "the OpenSSH key is encrypted, set privateKeyPassphrase",
+		},
+		{
+			name:       "encrypted key with the right passphrase",
+			keyFile:    func(t *testing.T) string { return copyKeyFile(t, "ed25519-openssh-encrypted") },
+			passphrase: "pw",
+			publicKey:  "ed25519-openssh-encrypted.pub",
+		},
+		{
+			name:       "encrypted key with a wrong passphrase",
+			keyFile:    func(t *testing.T) string { return copyKeyFile(t, "ed25519-openssh-encrypted") },
+			passphrase: "wrong",
+			wantErr:    x509.IncorrectPasswordError,
+			wantMsg:    "wrong privateKeyPassphrase for the OpenSSH key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := test.keyFile(t)
+			configuration := Configurations{
+				User:                  "tester",
+				Host:                  "localhost",
+				PrivateKeyFile:        file,
+				PrivateKeyPassphrase:  test.passphrase,
+				StrictHostKeyChecking: "no",
+			}
+
+			sshConfig, err := getSshConfig(configuration)
+			if test.wantMsg != "" || test.wantErr != nil {
+				if err == nil {
+					t.Fatal("getSshConfig succeeded, want an error")
+				}
+				if !strings.HasPrefix(err.Error(), "could not read privateKeyFile at "+file+": ") {
+					t.Errorf("error %q doesn't name the privateKeyFile", err)
+				}
+				if !strings.Contains(err.Error(), test.wantMsg) {
+					t.Errorf("error %q, want it to contain %q", err, test.wantMsg)
+				}
+				if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+					t.Errorf("error %q doesn't wrap %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSshConfig: %s", err)
+			}
+			if len(sshConfig.Auth) != 1 {
+				t.Fatalf("got %d auth methods, want 1", len(sshConfig.Auth))
+			}
+
+			// The server only takes the key of the testdata
+			buf, err := ioutil.ReadFile(filepath.Join("testdata", "keys", test.publicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticate(t, sshConfig.ClientConfig, want)
+		})
+	}
+}
+
+// authenticate logs in with the client configuration to a server accepting
+// only the given key
+func authenticate(t *testing.T, sshConfig *ssh.ClientConfig, want ssh.PublicKey) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), want.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		if conn, _, _, err := ssh.NewServerConn(server, serverConfig); err == nil {
+			conn.Wait()
+		}
+	}()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), sshConfig)
+	if err != nil {
+		t.Fatalf("authenticating with the key: %s", err)
+	}
+	conn.Close()
+}
+
+// startShellServer runs an SSH server taking any user, whose sessions run
+// shell on their channel. It returns the address to dial.
+func startShellServer(t *testing.T, shell func(ch ssh.Channel) uint32) string {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveShell(conn, serverConfig, shell)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveShell(conn net.Conn, serverConfig *ssh.ServerConfig, shell func(ch ssh.Channel) uint32) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range requests {
+				request.Reply(request.Type == "shell" || request.Type == "exec", nil)
+				if request.Type == "shell" || request.Type == "exec" {
+					status := make([]byte, 4)
+					binary.BigEndian.PutUint32(status, shell(ch))
+					ch.SendRequest("exit-status", false, status)
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestGetFingerprint(t *testing.T) {
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "keys", "ed25519-openssh.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As ssh-keygen -l shows them
+	for hash, want := range map[string]string{
+		"":       "SHA256:fhtpL8uzRXabKbVHFG9EAlGIcI7hTRtoOTQsBAaOSPg",
+		"sha256": "SHA256:fhtpL8uzRXabKbVHFG9EAlGIcI7hTRtoOTQsBAaOSPg",
+		"md5":    "MD5:c3:b1:4f:d0:22:bb:12:05:7a:c9:65:0c:3f:4c:f7:83",
+	} {
+		if got := getFingerprint(key, hash); got != want {
+			t.Errorf("fingerprintHash %q: got %s, want %s", hash, got, want)
+		}
+	}
+}
+
+func TestAtExit(t *testing.T) {
+	var ran []string
+	removeFirst := atExit(func() { ran = append(ran, "first") })
+	removeSecond := atExit(func() { ran = append(ran, "second") })
+	defer removeSecond()
+
+	// The hook of a session that is over doesn't run again
+	removeFirst()
+	runExitHooks()
+	if len(ran) != 1 || ran[0] != "second" {
+		t.Errorf("ran %v, want only the second hook", ran)
+	}
+}
+
+func TestSudoResponderDone(t *testing.T) {
+	isDone := func(s *sudoResponder) bool {
+		select {
+		case <-s.done:
+			return true
+		default:
+			return false
+		}
+	}
+	failed := func(category error, reason string) { t.Errorf("failed: %s", reason) }
+
+	// Without a timeout the input isn't held open for the prompt, but a
+	// prompt is still answered whenever it shows up
+	var stdin bytes.Buffer
+	s := newSudoResponder(&stdin, "secret", "\n", 0, failed)
+	s.start()
+	if !isDone(s) {
+		t.Error("done is open without a timeout")
+	}
+	s.watch([]byte("[sudo] password for tester: "))
+	if stdin.String() != "secret\n" {
+		t.Errorf("got %q on stdin, want the password", stdin.String())
+	}
+
+	// With a timeout, a session that ends before the prompt closes done
+	s = newSudoResponder(ioutil.Discard, "secret", "\n", time.Hour, failed)
+	s.start()
+	if isDone(s) {
+		t.Error("done is closed before the prompt")
+	}
+	s.stop()
+	if !isDone(s) {
+		t.Error("done is open after the session ended")
+	}
+}
+
+func dialTestServer(t *testing.T, address string) *ssh.Client {
+	t.Helper()
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// TestRunSessionFullDuplex has the remote write far more than the window
+// of the channel before it reads any input, while as much input is waiting
+// to be sent. Input and output have to move independently for the session
+// to finish.
+func TestRunSessionFullDuplex(t *testing.T) {
+	const outputBytes = 8 << 20
+	const inputLines = 100000
+
+	address := startShellServer(t, func(ch ssh.Channel) uint32 {
+		chunk := bytes.Repeat([]byte("info depth 1 score cp 0\n"), 1024)
+		for written := 0; written < outputBytes; written += len(chunk) {
+			if _, err := ch.Write(chunk); err != nil {
+				return 1
+			}
+		}
+		lines := 0
+		scanner := bufio.NewScanner(ch)
+		for scanner.Scan() {
+			lines++
+		}
+		fmt.Fprintf(ch, "read %d lines\n", lines)
+		return 0
+	})
+	client := dialTestServer(t, address)
+
+	var commands strings.Builder
+	for i := 0; i < inputLines; i++ {
+		fmt.Fprintf(&commands, "position startpos moves e2e4 %d\n", i)
+	}
+	commandFile := filepath.Join(t.TempDir(), "commands.txt")
+	if err := ioutil.WriteFile(commandFile, []byte(commands.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output is the engine's stdout
+	var output bytes.Buffer
+
+	configuration := Configurations{
+		Exec:            true,
+		CommandFile:     commandFile,
+		MaxInputLine:    1 << 20,
+		LineEnding:      "lf",
+		OutputBuffering: "none",
+	}
+	done := make(chan int, 1)
+	go func() {
+		exitCode, failure := runSession(client, configuration, sessionStreams{stdin: strings.NewReader(""), stdout: &output, stderr: ioutil.Discard}, nil)
+		if failure != nil {
+			t.Errorf("runSession failed: %s", failure.message)
+		}
+		done <- exitCode
+	}()
+
+	select {
+	case exitCode := <-done:
+		if exitCode != 0 {
+			t.Errorf("exit code %d, want 0", exitCode)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("the session deadlocked")
+	}
+
+	buf := output.Bytes()
+	if len(buf) < outputBytes {
+		t.Errorf("got %d bytes of output, want at least %d", len(buf), outputBytes)
+	}
+	if want := fmt.Sprintf("read %d lines\n", inputLines); !bytes.HasSuffix(buf, []byte(want)) {
+		t.Errorf("output doesn't end with %q", want)
+	}
+}
+
+// TestDialConcurrentSessions runs many sessions of the engine at once on
+// one client from dial, run it with -race
+func TestDialConcurrentSessions(t *testing.T) {
+	const sessions = 50
+
+	address := startShellServer(t, func(ch ssh.Channel) uint32 {
+		fmt.Fprintln(ch, "readyok")
+		return 0
+	})
+	client, err := dial([]string{address}, &net.Dialer{}, &clientConfig{ClientConfig: &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	configuration := Configurations{
+		RemoteCommand:   "isready",
+		Exec:            true,
+		DirectExec:      true,
+		MaxInputLine:    1 << 20,
+		LineEnding:      "lf",
+		OutputBuffering: "none",
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var output bytes.Buffer
+			exitCode, failure := runSession(client, configuration, sessionStreams{stdin: strings.NewReader(""), stdout: &output, stderr: ioutil.Discard}, nil)
+			if failure != nil {
+				errs <- fmt.Errorf("runSession failed: %s", failure.message)
+			} else if exitCode != 0 {
+				errs <- fmt.Errorf("exit code %d, want 0", exitCode)
+			} else if output.String() != "readyok\n" {
+				errs <- fmt.Errorf("got output %q, want %q", output.String(), "readyok\n")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestDialBannerTimeout connects to a server that takes the connection but
+// never sends its version line
+func TestDialBannerTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+	}()
+
+	_, err = dial([]string{listener.Addr().String()}, &net.Dialer{}, &clientConfig{
+		ClientConfig: &ssh.ClientConfig{
+			User:            "tester",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		bannerTimeout: 100 * time.Millisecond,
+	})
+	if !errors.Is(err, errBannerTimeout) {
+		t.Fatalf("got %v, want %v", err, errBannerTimeout)
+	}
+	if want := "within bannerTimeout (100ms)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+// TestDialHostKeyRejected checks that a rejected host key is still told
+// apart once the ssh package reported the failed handshake
+func TestDialHostKeyRejected(t *testing.T) {
+	address := startShellServer(t, func(ch ssh.Channel) uint32 { return 0 })
+
+	_, err := dial([]string{address}, &net.Dialer{}, &clientConfig{
+		ClientConfig: &ssh.ClientConfig{
+			User: "tester",
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				return fmt.Errorf("%w: for %s", errHostKeyChanged, hostname)
+			},
+		},
+	})
+	if !errors.Is(err, errHostKeyChanged) {
+		t.Fatalf("got %v, want %v", err, errHostKeyChanged)
+	}
+	if category := getDialErrorCategory(err); category != errAuth {
+		t.Errorf("got category %v, want %v", category, errAuth)
+	}
+}
+
+// TestDialHostAuthMethods checks that the authentication methods are those
+// of the host actually dialed, not the first one configured
+func TestDialHostAuthMethods(t *testing.T) {
+	address := startShellServer(t, func(ch ssh.Channel) uint32 { return 0 })
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	client, err := dial([]string{net.JoinHostPort("127.0.0.1", "1"), net.JoinHostPort("localhost", port)}, &net.Dialer{}, &clientConfig{
+		ClientConfig: &ssh.ClientConfig{
+			User:            "tester",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		hostAuthMethods: func(host string) ([]ssh.AuthMethod, error) {
+			hosts = append(hosts, host)
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if len(hosts) != 1 || hosts[0] != "localhost" {
+		t.Errorf("got the methods for %v, want them for localhost only", hosts)
+	}
+}
+
+func TestApplyHostFlag(t *testing.T) {
+	for flag, want := range map[string]Configurations{
+		"other":                {User: "tester", Host: "other", Port: "22"},
+		"alice@other":          {User: "alice", Host: "other", Port: "22"},
+		"other:2222":           {User: "tester", Host: "other", Port: "2222"},
+		"alice@[::1]:2222":     {User: "alice", Host: "::1", Port: "2222"},
+		"alice@":               {User: "alice", Host: "engine", Port: "22"},
+		"alice@other.example:": {User: "alice", Host: "other.example", Port: "22"},
+	} {
+		configuration := Configurations{User: "tester", Host: "engine", Port: "22"}
+		applyHostFlag(&configuration, flag)
+		if configuration.User != want.User || configuration.Host != want.Host || configuration.Port != want.Port {
+			t.Errorf("--host %s: got %s@%s port %s, want %s@%s port %s", flag, configuration.User, configuration.Host, configuration.Port, want.User, want.Host, want.Port)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "strings"
+
+// getFlagValue returns the value of the command line flag name, given as
+// either --name value or --name=value, or the empty string without one.
+// Anything else on the command line is left alone, as chess GUIs may pass
+// arguments of their own.
+func getFlagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+
+	return ""
+}
+
+// removeFlag returns the arguments without the flag name and its value
+func removeFlag(args []string, name string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == name {
+			i++
+			continue
+		}
+		if strings.HasPrefix(args[i], name+"=") {
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+
+	return rest
+}
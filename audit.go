@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+var errAuditFailed = errors.New("could not write to the audit log")
+
+// auditEntry is one line of the audit log. With the hash chain on, Hash is
+// the SHA-256 of the JSON of the entry without its hash field, which holds
+// the hash of the entry before it.
+type auditEntry struct {
+	Time      string `json:"time"`
+	Host      string `json:"host"`
+	User      string `json:"user"`
+	LocalUser string `json:"localUser"`
+	Command   string `json:"command"`
+	PrevHash  string `json:"prevHash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// auditLog appends every command sent to the remote to a JSON lines file
+type auditLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	host      string
+	user      string
+	localUser string
+	hashChain bool
+	lastHash  string
+}
+
+func openAuditLog(path string, host string, remoteUser string, hashChain bool) (*auditLog, error) {
+	audit := &auditLog{host: host, user: remoteUser, hashChain: hashChain}
+	if current, err := user.Current(); err == nil {
+		audit.localUser = current.Username
+	}
+
+	// Continue the chain from the last entry already in the file
+	if hashChain {
+		lastHash, err := readLastAuditHash(path)
+		if err != nil {
+			return nil, err
+		}
+		audit.lastHash = lastHash
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the audit log: %w", err)
+	}
+	audit.file = file
+
+	return audit, nil
+}
+
+func readLastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not read the audit log: %w", err)
+	}
+	defer file.Close()
+
+	var last string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			last = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("could not read the audit log: %w", err)
+	}
+	if last == "" {
+		return "", nil
+	}
+
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(last), &entry); err != nil {
+		return "", fmt.Errorf("could not parse the last entry of the audit log: %w", err)
+	}
+
+	return entry.Hash, nil
+}
+
+func (a *auditLog) record(command string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Host:      a.host,
+		User:      a.user,
+		LocalUser: a.localUser,
+		Command:   command,
+	}
+
+	if a.hashChain {
+		entry.PrevHash = a.lastHash
+		unhashed, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errAuditFailed, err)
+		}
+		sum := sha256.Sum256(unhashed)
+		entry.Hash = hex.EncodeToString(sum[:])
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errAuditFailed, err)
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("%w: %s", errAuditFailed, err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("%w: %s", errAuditFailed, err)
+	}
+	// The chain goes on from the entries that made it to the file
+	a.lastHash = entry.Hash
+
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultAuthMethods is the order methods are tried in when authMethods is
+// not set. Only the methods that are configured are used.
+var defaultAuthMethods = []string{"kerberos", "agent", "key", "keyboard-interactive", "password"}
+
+func getAuthMethods(configuration Configurations) ([]ssh.AuthMethod, error) {
+	names, explicit := getAuthMethodNames(configuration)
+
+	var authMethods []ssh.AuthMethod
+	for _, name := range names {
+		method, err := getAuthMethod(name, configuration)
+		if err != nil {
+			return nil, err
+		}
+		if method != nil {
+			authMethods = append(authMethods, method)
+		}
+	}
+
+	if len(authMethods) == 0 {
+		if !explicit && !isAnyAuthMethodConfigured(configuration) {
+			// Like plain ssh, ask for the password when there is someone to ask
+			if isTerminal() {
+				return getPasswordPromptMethods(configuration), nil
+			}
+			return nil, fmt.Errorf("no authentication method configured, set one of privateKeyFile, useAgent, password or kerberos")
+		}
+		return nil, fmt.Errorf("no authentication method available")
+	}
+
+	return authMethods, nil
+}
+
+// getAuthMethodNames returns the methods to try, in order, and whether
+// authMethods lists them
+func getAuthMethodNames(configuration Configurations) ([]string, bool) {
+	names := configuration.AuthMethods
+	explicit := len(names) > 0
+	if !explicit {
+		names = defaultAuthMethods
+	}
+
+	var used []string
+	for _, name := range names {
+		if !explicit && !isAuthMethodConfigured(name, configuration) {
+			continue
+		}
+		// Like OpenSSH, only the configured key is offered, agent keys the
+		// server would reject count towards its MaxAuthTries
+		if name == "agent" && isIdentitiesOnly(configuration) {
+			continue
+		}
+		used = append(used, name)
+	}
+	return used, explicit
+}
+
+// passwordPrompts is how often the password is asked for, like OpenSSH's
+// NumberOfPasswordPrompts
+const passwordPrompts = 3
+
+// getPasswordPromptMethods asks for the password on the terminal, without
+// echoing it. Keyboard-interactive questions are put to the user as asked,
+// as servers use it for one-time codes as well.
+func getPasswordPromptMethods(configuration Configurations) []ssh.AuthMethod {
+	keyboardInteractive := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			fmt.Fprintln(os.Stderr, instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			answer, err := readTerminalLine(question, echos[i])
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	})
+	password := ssh.PasswordCallback(func() (string, error) {
+		tracef("Trying password authentication with the password typed in")
+		return readTerminalLine(fmt.Sprintf("%s@%s's password: ", configuration.User, configuration.Host), false)
+	})
+
+	return []ssh.AuthMethod{
+		ssh.RetryableAuthMethod(keyboardInteractive, passwordPrompts),
+		ssh.RetryableAuthMethod(password, passwordPrompts),
+	}
+}
+
+func isAuthMethodConfigured(name string, configuration Configurations) bool {
+	switch name {
+	case "kerberos":
+		return configuration.Kerberos
+	case "agent":
+		return configuration.UseAgent
+	case "key":
+		return configuration.PrivateKeyFile != ""
+	case "keyboard-interactive", "password":
+		return configuration.Password != ""
+	}
+	return false
+}
+
+func isIdentitiesOnly(configuration Configurations) bool {
+	return configuration.IdentitiesOnly || strings.EqualFold(configuration.Options["identitiesonly"], "yes")
+}
+
+// canRetryWithIdentitiesOnly tells whether agent keys are offered before
+// the configured key, which identitiesOnly would leave out
+func canRetryWithIdentitiesOnly(configuration Configurations) bool {
+	if isIdentitiesOnly(configuration) || configuration.PrivateKeyFile == "" {
+		return false
+	}
+	if len(configuration.AuthMethods) == 0 {
+		return configuration.UseAgent
+	}
+
+	agent, key := false, false
+	for _, name := range configuration.AuthMethods {
+		agent = agent || name == "agent"
+		key = key || name == "key"
+	}
+	return agent && key
+}
+
+// isTooManyAuthFailures tells whether the server gave up on us after more
+// attempts than its MaxAuthTries, which it reports as a disconnect message
+func isTooManyAuthFailures(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "too many authentication failures")
+}
+
+func isAnyAuthMethodConfigured(configuration Configurations) bool {
+	for _, name := range defaultAuthMethods {
+		if isAuthMethodConfigured(name, configuration) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAuthMethod returns the named method. Methods that are unavailable on
+// this machine, like Kerberos without a ticket, are skipped with a nil method
+// so the others can still be tried.
+func getAuthMethod(name string, configuration Configurations) (ssh.AuthMethod, error) {
+	switch name {
+	case "kerberos":
+		kerberos, err := newKerberosClient(configuration.Host)
+		if err != nil {
+			log.Printf("Skipping Kerberos authentication: %s", err)
+			return nil, nil
+		}
+		return ssh.GSSAPIWithMICAuthMethod(kerberos, configuration.Host), nil
+	case "agent":
+		signers, err := getAgentSigners()
+		if err != nil {
+			log.Printf("Skipping agent authentication: %s", err)
+			return nil, nil
+		}
+		return ssh.PublicKeysCallback(traceSigners(signers, configuration.FingerprintHash)), nil
+	case "key":
+		// Like OpenSSH, keys others can read are suspect
+		if err := checkKeyFilePermissions(configuration.PrivateKeyFile); err != nil {
+			if configuration.StrictPermissions {
+				return nil, err
+			}
+			log.Printf("Warning: %s", err)
+		}
+		key, err := getKeyFile(configuration.PrivateKeyFile, configuration.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("could not read privateKeyFile at %s: %w", configuration.PrivateKeyFile, err)
+		}
+		return ssh.PublicKeysCallback(traceSigners(func() ([]ssh.Signer, error) {
+			return []ssh.Signer{key}, nil
+		}, configuration.FingerprintHash)), nil
+	case "keyboard-interactive":
+		if configuration.Password == "" {
+			return nil, fmt.Errorf("authMethods lists keyboard-interactive but no password is configured")
+		}
+		// Servers commonly ask for the password this way, so answer every
+		// question with it
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			tracef("Answering %d keyboard-interactive questions with the password", len(questions))
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = configuration.Password
+			}
+			return answers, nil
+		}), nil
+	case "password":
+		if configuration.Password == "" {
+			return nil, fmt.Errorf("authMethods lists password but no password is configured")
+		}
+		return ssh.PasswordCallback(func() (string, error) {
+			tracef("Trying password authentication")
+			return configuration.Password, nil
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unknown authentication method %q in authMethods", name)
+}
+
+// checkAuthMethod checks what the named method needs on this machine,
+// without contacting the KDC or the agent like getAuthMethod does. The key
+// itself isn't read.
+func checkAuthMethod(name string, configuration Configurations) error {
+	switch name {
+	case "kerberos":
+		if _, err := os.Stat(getKerberosConfigPath()); err != nil {
+			return fmt.Errorf("could not load the Kerberos configuration: %w", err)
+		}
+		path, err := getKerberosCCachePath()
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("could not load the Kerberos credential cache: %w", err)
+		}
+	case "agent":
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return fmt.Errorf("SSH_AUTH_SOCK is not set")
+		}
+	case "key":
+		if configuration.PrivateKeyFile == "" {
+			return fmt.Errorf("authMethods lists key but no privateKeyFile is configured")
+		}
+	case "keyboard-interactive", "password":
+		if configuration.Password == "" {
+			return fmt.Errorf("authMethods lists %s but no password is configured", name)
+		}
+	default:
+		return fmt.Errorf("unknown authentication method %q in authMethods", name)
+	}
+	return nil
+}
+
+func getAgentSigners() (func() ([]ssh.Signer, error), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the SSH agent: %w", err)
+	}
+
+	return agent.NewClient(conn).Signers, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// readCommandFile reads the commands of a command file, one per line, and
+// returns them as the input to send. Blank lines and comments starting with
+// # are left out, so the file can explain itself. Lines with a when clause
+// are only allowed if conditional is set, as they need commandMarker.
+func readCommandFile(path string, conditional bool) (*strings.Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var commands strings.Builder
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		condition, _, err := parseCommandCondition(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		if condition != nil && !conditional {
+			return nil, fmt.Errorf("line %d: a when clause requires commandMarker", number)
+		}
+		commands.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return strings.NewReader(commands.String()), nil
+}
+
+// commandCondition is the when clause in front of a command, which has the
+// command sent only if the command before did as the clause asks
+type commandCondition struct {
+	text    string
+	stream  string
+	equal   bool
+	status  int
+	pattern *regexp.Regexp
+}
+
+var commandConditionPattern = regexp.MustCompile(`^when (prev\.(?:exit (==|!=) (-?\d+)|(stdout|stderr) matches '(.*?)')):\s+(\S.*)$`)
+
+// parseCommandCondition splits the when clause off the line, if there is
+// one. It returns the command that goes with it.
+func parseCommandCondition(line string) (*commandCondition, string, error) {
+	if !strings.HasPrefix(line, "when ") {
+		return nil, line, nil
+	}
+
+	match := commandConditionPattern.FindStringSubmatch(line)
+	if match == nil {
+		return nil, "", fmt.Errorf("invalid when clause, expected when prev.exit == <status>: <command>, when prev.exit != <status>: <command> or when prev.stdout matches '<pattern>': <command>")
+	}
+	condition := &commandCondition{text: match[1]}
+	if match[4] == "" {
+		condition.stream = "exit"
+		condition.equal = match[2] == "=="
+		condition.status, _ = strconv.Atoi(match[3])
+	} else {
+		pattern, err := regexp.Compile(match[5])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid pattern in the when clause: %w", err)
+		}
+		condition.stream = match[4]
+		condition.pattern = pattern
+	}
+
+	return condition, match[6], nil
+}
+
+// holds tells whether the condition holds for the result of the command
+// before. It doesn't hold for a command that was skipped or didn't finish.
+func (c *commandCondition) holds(prev commandResult, finished bool) bool {
+	if !finished {
+		return false
+	}
+	switch c.stream {
+	case "stdout":
+		return c.pattern.Match(prev.stdout)
+	case "stderr":
+		return c.pattern.Match(prev.stderr)
+	}
+	return (prev.exitStatus == c.status) == c.equal
+}
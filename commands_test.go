@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandCondition(t *testing.T) {
+	ran := func(status int, stdout string, stderr string) commandResult {
+		return commandResult{exitStatus: status, stdout: []byte(stdout), stderr: []byte(stderr)}
+	}
+
+	tests := []struct {
+		line    string
+		command string
+		prev    commandResult
+		holds   bool
+	}{
+		{"when prev.exit == 0: echo ok", "echo ok", ran(0, "", ""), true},
+		{"when prev.exit == 0: echo ok", "echo ok", ran(1, "", ""), false},
+		{"when prev.exit != 0:  systemctl start nginx", "systemctl start nginx", ran(3, "", ""), true},
+		{"when prev.exit == 3: echo three", "echo three", ran(3, "", ""), true},
+		{"when prev.stdout matches 'active': systemctl reload nginx", "systemctl reload nginx", ran(0, "active\n", ""), true},
+		{"when prev.stdout matches '^active$': echo yes", "echo yes", ran(0, "inactive\n", ""), false},
+		{"when prev.stdout matches '(?m)^active$': echo yes", "echo yes", ran(0, "active\n", ""), true},
+		{"when prev.stderr matches 'denied': echo retry", "echo retry", ran(1, "", "permission denied\n"), true},
+		{"when prev.stderr matches 'denied': echo retry", "echo retry", ran(1, "denied\n", ""), false},
+	}
+
+	for _, test := range tests {
+		condition, command, err := parseCommandCondition(test.line)
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+		if command != test.command {
+			t.Errorf("%q: got command %q, want %q", test.line, command, test.command)
+		}
+		if got := condition.holds(test.prev, true); got != test.holds {
+			t.Errorf("%q: holds got %v, want %v", test.line, got, test.holds)
+		}
+		// Nothing holds for a command that was skipped
+		if condition.holds(test.prev, false) {
+			t.Errorf("%q holds without a command before", test.line)
+		}
+	}
+
+	if condition, command, err := parseCommandCondition("whenever"); condition != nil || command != "whenever" || err != nil {
+		t.Errorf("a line without a when clause got %v, %q, %v", condition, command, err)
+	}
+
+	for _, line := range []string{
+		"when prev.exit > 0: echo",
+		"when prev.exit == 0 echo",
+		"when prev.exit == 0:",
+		"when prev.stdout matches active: echo",
+		"when prev.stdout matches '(': echo",
+	} {
+		if _, _, err := parseCommandCondition(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestReadCommandFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "commands")
+	content := "# check nginx\n\nsystemctl is-active nginx\nwhen prev.stdout matches 'active': systemctl reload nginx\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	commands, err := readCommandFile(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(commands)
+	if want := "systemctl is-active nginx\nwhen prev.stdout matches 'active': systemctl reload nginx\n"; string(buf) != want {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+
+	_, err = readCommandFile(file, false)
+	if want := "line 4: a when clause requires commandMarker"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("without commandMarker got %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// readConfiguration reads engine.yml, with the settings of the named profile
+// on top when profile isn't empty. Without one, choose lets the profile be
+// picked from a menu.
+func readConfiguration(profile string, choose bool) Configurations {
+	if _, err := os.Stat("engine.yml"); os.IsNotExist(err) {
+		exitWithConfigurationError("The file 'engine.yml' could not be found in the current directory")
+	}
+
+	viper.SetConfigName("engine")
+	viper.SetConfigType("yml")
+	viper.AddConfigPath(".")
+	setConfigurationDefaults()
+
+	// Read the configuration
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			exitWithConfigurationError("No such config file")
+		}
+		exitWithConfigurationError(fmt.Sprintf("Error reading the engine.yml file: %s", err))
+	}
+
+	// Misspelled keys are silently ignored by Unmarshal, so point them out
+	// further down. Once a profile is merged its keys show up twice.
+	unknown := getUnknownConfigurationKeys()
+
+	if profile == "" && choose {
+		chosen, err := chooseProfile()
+		if err != nil {
+			exitWithConfigurationError(fmt.Sprintf("Unable to choose a profile: %v", err))
+		}
+		profile = chosen
+	}
+
+	// A profile overrides the base settings key by key, nested maps included
+	if profile != "" {
+		settings, ok := viper.Get("profiles." + profile).(map[string]interface{})
+		if !ok {
+			exitWithConfigurationError(fmt.Sprintf("The profile '%s' could not be found in the engine.yml file", profile))
+		}
+		if err := viper.MergeConfigMap(settings); err != nil {
+			exitWithConfigurationError(fmt.Sprintf("Unable to apply the profile '%s': %v", profile, err))
+		}
+	}
+
+	var configuration Configurations
+	if err := viper.Unmarshal(&configuration); err != nil {
+		exitWithConfigurationError(fmt.Sprintf("Unable to decode the engine.yml file: %v", err))
+	}
+
+	// The host may be given as user@host:port, like with other SSH tools. The
+	// user and port only count when they aren't set on their own.
+	user, host, port := parseHostString(configuration.Host)
+	configuration.Host = host
+	if user != "" && !viper.InConfig("user") {
+		configuration.User = user
+	}
+	if port != "" && !viper.InConfig("port") {
+		configuration.Port = port
+	}
+
+	// The script is fed through stdin, so there is no input to forward after it
+	if configuration.RemoteScriptFile != "" {
+		if configuration.RemoteCommand != "" {
+			exitWithConfigurationError("Only one of remoteCommand and remoteScriptFile can be set in the engine.yml file")
+		}
+		configuration.Exec = true
+	}
+
+	if configuration.Daemon {
+		if configuration.RemoteCommand != "" || configuration.RemoteScriptFile != "" || configuration.InteractiveAfterCommand {
+			exitWithConfigurationError("daemon runs no session, so remoteCommand, remoteScriptFile and interactiveAfterCommand can't be set with it in the engine.yml file")
+		}
+		if len(configuration.LocalForwards) == 0 && len(configuration.RemoteForwards) == 0 {
+			exitWithConfigurationError("daemon requires localForwards or remoteForwards in the engine.yml file")
+		}
+	}
+
+	if configuration.WebsocketURL != "" && len(configuration.FallbackHosts) > 0 {
+		exitWithConfigurationError("fallbackHosts can't be used together with websocketURL in the engine.yml file")
+	}
+
+	// Like OpenSSH, the option works too, unless the setting is there
+	if option, ok := configuration.Options["stricthostkeychecking"]; ok && !viper.InConfig("stricthostkeychecking") {
+		configuration.StrictHostKeyChecking = strings.ToLower(option)
+	}
+	switch configuration.StrictHostKeyChecking {
+	case "yes", "ask", "no":
+	default:
+		exitWithConfigurationError("strictHostKeyChecking must be yes, ask or no in the engine.yml file")
+	}
+
+	// Windows keeps the tickets in LSA, where there is no credential cache
+	// file to read them from
+	if runtime.GOOS == "windows" && usesKerberos(configuration) {
+		exitWithConfigurationError("kerberos is not supported on Windows, remove it from the engine.yml file")
+	}
+
+	if configuration.LogTarget != "file" && configuration.LogTarget != "syslog" {
+		exitWithConfigurationError("logTarget must be file or syslog in the engine.yml file")
+	}
+
+	if configuration.FingerprintHash != "sha256" && configuration.FingerprintHash != "md5" {
+		exitWithConfigurationError("fingerprintHash must be sha256 or md5 in the engine.yml file")
+	}
+
+	if configuration.OutputBuffering != "none" && configuration.OutputBuffering != "line" {
+		exitWithConfigurationError("outputBuffering must be none or line in the engine.yml file")
+	}
+
+	if configuration.TimestampOutput && strings.TrimSpace(configuration.TimestampFormat) == "" {
+		exitWithConfigurationError("timestampFormat can't be empty with timestampOutput in the engine.yml file")
+	}
+
+	if configuration.WaitForPrompt && !configuration.InteractiveAfterCommand {
+		exitWithConfigurationError("waitForPrompt requires interactiveAfterCommand in the engine.yml file")
+	}
+	if configuration.AutoReconnect && !configuration.InteractiveAfterCommand {
+		exitWithConfigurationError("autoReconnect requires interactiveAfterCommand in the engine.yml file")
+	}
+	if configuration.CommandTiming && configuration.CommandMarker == "" {
+		exitWithConfigurationError("commandTiming requires commandMarker in the engine.yml file")
+	}
+	if configuration.CommandResultsFile != "" && configuration.CommandMarker == "" {
+		exitWithConfigurationError("commandResultsFile requires commandMarker in the engine.yml file")
+	}
+	if configuration.CommandMarker != "" && (configuration.RemoteScriptFile != "" || configuration.InteractiveAfterCommand) {
+		exitWithConfigurationError("commandMarker can't be used together with remoteScriptFile or interactiveAfterCommand in the engine.yml file")
+	}
+
+	if configuration.CommandPipe != "" && (configuration.Exec || configuration.InteractiveAfterCommand) {
+		exitWithConfigurationError("commandPipe can't be used together with exec, remoteScriptFile or interactiveAfterCommand in the engine.yml file")
+	}
+
+	for _, t := range configuration.Downloads {
+		if t.Owner != "" || t.Group != "" {
+			exitWithConfigurationError("owner and group can only be set on uploads in the engine.yml file")
+		}
+	}
+
+	for _, pattern := range configuration.SendEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			exitWithConfigurationError(fmt.Sprintf("Invalid sendEnv pattern '%s' in the engine.yml file", pattern))
+		}
+	}
+
+	checkCommandFile(configuration)
+
+	if configuration.QuietExit && !configuration.Exec {
+		exitWithConfigurationError("quietExit requires exec or remoteScriptFile in the engine.yml file")
+	}
+
+	// Only a command that runs to its end can be run again
+	if configuration.RetryOnOutputMatch != "" && !configuration.Exec {
+		exitWithConfigurationError("retryOnOutputMatch requires exec or remoteScriptFile in the engine.yml file")
+	}
+
+	if configuration.NoMoreSessions && configuration.RetryOnOutputMatch != "" {
+		exitWithConfigurationError("noMoreSessions can't be used together with retryOnOutputMatch in the engine.yml file, a retry needs a new session")
+	}
+
+	if len(configuration.EscapeChar) != 1 && configuration.EscapeChar != "none" {
+		exitWithConfigurationError("escapeChar must be a single character or none in the engine.yml file")
+	}
+
+	if configuration.LineEnding != "lf" && configuration.LineEnding != "crlf" && configuration.LineEnding != "auto" {
+		exitWithConfigurationError("lineEnding must be lf, crlf or auto in the engine.yml file")
+	}
+
+	if configuration.MaxInputLine <= 0 {
+		exitWithConfigurationError("maxInputLine must be a positive number of bytes in the engine.yml file")
+	}
+
+	if configuration.ServerAliveCountMax < 1 {
+		exitWithConfigurationError("serverAliveCountMax must be at least 1 in the engine.yml file")
+	}
+
+	if configuration.RetryDeadline < 0 {
+		exitWithConfigurationError("retryDeadline must be a number of seconds, or 0 for no deadline, in the engine.yml file")
+	}
+
+	// Neither a script nor raw terminal input can be checked line by line
+	if len(configuration.AllowedCommands) > 0 {
+		if configuration.RemoteScriptFile != "" || configuration.InteractiveAfterCommand {
+			exitWithConfigurationError("allowedCommands can't be used together with remoteScriptFile or interactiveAfterCommand in the engine.yml file")
+		}
+	}
+	if configuration.AuditLogFile != "" && configuration.InteractiveAfterCommand {
+		exitWithConfigurationError("auditLogFile can't be used together with interactiveAfterCommand in the engine.yml file")
+	}
+
+	if len(unknown) > 0 {
+		for _, key := range unknown {
+			fmt.Fprintf(os.Stderr, "Unknown key '%s' in the engine.yml file\n", key)
+		}
+		if configuration.StrictConfig {
+			if jsonOutput {
+				fatal(errConfig, "Unknown keys in the engine.yml file: "+strings.Join(unknown, ", "), nil)
+			}
+			os.Exit(1)
+		}
+	}
+
+	return configuration
+}
+
+// usesKerberos tells whether Kerberos is one of the authentication methods
+func usesKerberos(configuration Configurations) bool {
+	if configuration.Kerberos {
+		return true
+	}
+	for _, name := range configuration.AuthMethods {
+		if name == "kerberos" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostString splits [user@]host[:port] into its parts, leaving out the
+// ones it doesn't have. IPv6 addresses need brackets to go with a port.
+func parseHostString(s string) (string, string, string) {
+	var user string
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user, s = s[:i], s[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return user, host, port
+	}
+	return user, s, ""
+}
+
+// checkCommandFile rejects what a command file can't go with, the other
+// sources of input. It is checked again when --command-file sets it.
+func checkCommandFile(configuration Configurations) {
+	if configuration.CommandFile != "" && (configuration.RemoteScriptFile != "" || configuration.InteractiveAfterCommand || configuration.CommandPipe != "") {
+		exitWithConfigurationError("commandFile can't be used together with remoteScriptFile, interactiveAfterCommand or commandPipe in the engine.yml file")
+	}
+}
+
+// exitWithConfigurationError reports a problem with engine.yml, on stdout
+// as it always was unless the JSON output is asked for.
+func exitWithConfigurationError(message string) {
+	if jsonOutput {
+		fatal(errConfig, message, nil)
+	}
+	fmt.Println(message)
+	os.Exit(1)
+}
+
+func getUnknownConfigurationKeys() []string {
+	known := make(map[string]bool)
+	for _, key := range getConfigurationKeys() {
+		known[strings.ToLower(key.Name)] = true
+	}
+
+	// viper lower cases the keys and flattens nested maps with dots. The keys
+	// of a profile are the ones under its name.
+	var unknown []string
+	for _, key := range viper.AllKeys() {
+		parts := strings.SplitN(key, ".", 4)
+		name := parts[0]
+		if name == "profiles" && len(parts) > 2 {
+			name = parts[2]
+		}
+		if !known[name] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	return unknown
+}
+
+// Configurations holds the settings from engine.yml. The desc and default
+// tags feed both the schema subcommand and the defaults given to viper.
+type Configurations struct {
+	User                    string            `mapstructure:"user" desc:"User to log in as on the remote host"`
+	PrivateKeyFile          string            `mapstructure:"privateKeyFile" desc:"Private key used to authenticate"`
+	PrivateKeyPassphrase    string            `mapstructure:"privateKeyPassphrase" secret:"true" desc:"Passphrase of an encrypted private key"`
+	StrictPermissions       bool              `mapstructure:"strictPermissions" desc:"Refuse a private key file others can access, instead of warning"`
+	Host                    string            `mapstructure:"host" desc:"Host name or IP address of the remote server"`
+	Port                    string            `mapstructure:"port" default:"22" desc:"SSH port of the remote server"`
+	RemoteCommand           string            `mapstructure:"remoteCommand" desc:"Command run in the remote shell first, usually the engine"`
+	Hash                    string            `mapstructure:"hash" desc:"Overrides the Hash value set by the chess GUI"`
+	Threads                 string            `mapstructure:"threads" desc:"Overrides the Threads value set by the chess GUI"`
+	LogFileName             string            `mapstructure:"logFileName" desc:"Enables debug logging to a log file"`
+	LogTarget               string            `mapstructure:"logTarget" default:"file" desc:"Where the log goes, file (logFileName, or stderr without one) or syslog"`
+	SyslogFacility          string            `mapstructure:"syslogFacility" default:"user" desc:"Syslog facility of logTarget syslog, like user, daemon or local0"`
+	SyslogTag               string            `mapstructure:"syslogTag" default:"ssh-engine" desc:"Tag of the syslog messages"`
+	SyslogOutput            bool              `mapstructure:"syslogOutput" desc:"Also log every line sent to and received from the remote to syslog"`
+	TraceSsh                bool              `mapstructure:"traceSsh" desc:"Log the algorithms offered and the authentication attempts, to diagnose handshakes"`
+	FingerprintHash         string            `mapstructure:"fingerprintHash" default:"sha256" desc:"Format key fingerprints are shown and passed to hostKeyVerifierCommand in, sha256 or md5"`
+	StrictHostKeyChecking   string            `mapstructure:"strictHostKeyChecking" default:"ask" desc:"yes only accepts hosts in knownHostsFile, ask asks to add new ones on a terminal (and rejects them without one), no accepts any host key"`
+	AcceptChangedHostKey    bool              `mapstructure:"acceptChangedHostKey" desc:"Replace a known host key that has changed instead of refusing to connect, only for a planned rebuild of the server"`
+	KnownHostsFile          string            `mapstructure:"knownHostsFile" default:"~/.ssh/known_hosts" desc:"OpenSSH known_hosts files host keys are checked against, separated by spaces, new ones are added to the first"`
+	VerifySshfp             bool              `mapstructure:"verifySshfp" desc:"Trust host keys matching DNSSEC validated SSHFP records of the host, before checking knownHostsFile"`
+	DnsServer               string            `mapstructure:"dnsServer" desc:"DNS server (host[:port]) verifySshfp looks the records up with, the first nameserver of /etc/resolv.conf by default"`
+	HostKeyVerifierCommand  string            `mapstructure:"hostKeyVerifierCommand" desc:"Program deciding whether to trust the host key"`
+	Kerberos                bool              `mapstructure:"kerberos" desc:"Authenticate with tickets from the Kerberos credential cache"`
+	StrictConfig            bool              `mapstructure:"strictConfig" desc:"Refuse to start when engine.yml has unknown keys"`
+	UseAgent                bool              `mapstructure:"useAgent" desc:"Authenticate with the keys in the SSH agent (SSH_AUTH_SOCK)"`
+	IdentitiesOnly          bool              `mapstructure:"identitiesOnly" desc:"Never offer the keys in the SSH agent, only the configured key"`
+	RetryWithIdentitiesOnly bool              `mapstructure:"retryWithIdentitiesOnly" default:"true" desc:"Connect again with only the configured key when the agent keys ran into too many authentication failures"`
+	Password                string            `mapstructure:"password" secret:"true" desc:"Password for password and keyboard-interactive authentication"`
+	AuthMethods             []string          `mapstructure:"authMethods" desc:"Order to try authentication methods in (kerberos, agent, key, keyboard-interactive, password)"`
+	PreCommand              string            `mapstructure:"preCommand" desc:"Local command run before connecting, a failure aborts the run"`
+	PostCommand             string            `mapstructure:"postCommand" desc:"Local command run after the session, with SSH_ENGINE_EXIT_CODE set"`
+	RemotePath              string            `mapstructure:"remotePath" desc:"Directories put in front of the PATH of the remote shell, separated by colons"`
+	RemoteScriptFile        string            `mapstructure:"remoteScriptFile" desc:"Local script run by bash on the remote instead of remoteCommand, in exec mode"`
+	ScriptArgs              []string          `mapstructure:"scriptArgs" desc:"Arguments passed to remoteScriptFile"`
+	MaxInputLine            int               `mapstructure:"maxInputLine" default:"1048576" desc:"Longest line of input in bytes, a longer one stops the input"`
+	LineEnding              string            `mapstructure:"lineEnding" default:"auto" desc:"Line ending of the lines sent (lf, crlf, or auto for crlf on Windows servers only)"`
+	CommandPipe             string            `mapstructure:"commandPipe" desc:"Named pipe (FIFO) the input is read from instead of stdin"`
+	CommandFile             string            `mapstructure:"commandFile" desc:"File of commands sent one per line instead of the input, also --command-file"`
+	CommandMarker           string            `mapstructure:"commandMarker" desc:"Marker echoed after every shell command, the next one is only sent once it shows up"`
+	CommandTiming           bool              `mapstructure:"commandTiming" desc:"Print how long each command took after the session, requires commandMarker"`
+	CommandResultsFile      string            `mapstructure:"commandResultsFile" desc:"File the command, exit status, duration and output of each command are written to as JSON after the session, requires commandMarker"`
+	EchoCommands            bool              `mapstructure:"echoCommands" desc:"Write every command sent to stdout as + command, before its output"`
+	Exec                    bool              `mapstructure:"exec" desc:"Only run remoteCommand and close the session, without forwarding input"`
+	DirectExec              bool              `mapstructure:"directExec" default:"true" desc:"Run remoteCommand as the command of the session unless interactiveAfterCommand is set, false sends it to a shell instead"`
+	QuietExit               bool              `mapstructure:"quietExit" desc:"Leave out the remote output and exit with the remote exit status, 255 for failures of the engine"`
+	InteractiveAfterCommand bool              `mapstructure:"interactiveAfterCommand" desc:"Stay in the remote shell on a PTY after remoteCommand, on a terminal"`
+	AutoReconnect           bool              `mapstructure:"autoReconnect" desc:"Connect again and open a fresh shell when the connection of the interactive session is lost"`
+	ReconnectAttempts       int               `mapstructure:"reconnectAttempts" default:"5" desc:"Reconnect attempts of autoReconnect, waiting longer after each one"`
+	RetryDeadline           int               `mapstructure:"retryDeadline" desc:"Seconds autoReconnect keeps trying at most, even with reconnectAttempts left (0 for no limit)"`
+	EscapeChar              string            `mapstructure:"escapeChar" default:"~" desc:"Escape character of interactive mode, at the start of a line (none turns escapes off)"`
+	WaitForPrompt           bool              `mapstructure:"waitForPrompt" desc:"Wait for the shell prompt before sending anything to the shell"`
+	PromptPattern           string            `mapstructure:"promptPattern" default:"[$#%>] ?$" desc:"Regex matching the end of the shell prompt, for waitForPrompt"`
+	PromptTimeout           int               `mapstructure:"promptTimeout" default:"10" desc:"Seconds waitForPrompt waits, before sending anyway"`
+	SuppressEcho            bool              `mapstructure:"suppressEcho" desc:"Turn off echo on the remote PTY, so input isn't repeated in the output"`
+	RekeyThreshold          uint64            `mapstructure:"rekeyThreshold" desc:"Bytes sent before the session keys are renegotiated (1 MiB to 64 GiB)"`
+	Options                 map[string]string `mapstructure:"options" desc:"OpenSSH style options (ConnectTimeout, Ciphers, MACs, KexAlgorithms, HostKeyAlgorithms, IdentitiesOnly)"`
+	Expect                  []ExpectRule      `mapstructure:"expect" desc:"Prompts to answer, as a list of expect (regex), send and timeout (seconds)"`
+	SudoPassword            string            `mapstructure:"sudoPassword" secret:"true" desc:"Password sent once to the [sudo] password prompt, never logged"`
+	SudoPromptTimeout       int               `mapstructure:"sudoPromptTimeout" default:"30" desc:"Seconds the sudo prompt is waited for, a later prompt closes the session (0 answers it whenever it shows up, without holding the input open for it)"`
+	ExitGrace               int               `mapstructure:"exitGrace" default:"2" desc:"Seconds the remote gets to finish its output when the engine closes the session early"`
+	AllowedCommands         []string          `mapstructure:"allowedCommands" desc:"Only send these commands (exact, or /regex/), others are refused locally"`
+	AuditLogFile            string            `mapstructure:"auditLogFile" desc:"JSON lines file recording every command sent to the remote"`
+	AuditHashChain          bool              `mapstructure:"auditHashChain" desc:"Chain the audit log entries with SHA-256 hashes, so edits show"`
+	MergeStderr             bool              `mapstructure:"mergeStderr" desc:"Write the remote stderr to stdout, instead of to stderr"`
+	OutputBuffering         string            `mapstructure:"outputBuffering" default:"none" desc:"none writes output through as it arrives, line holds it back until a line is complete"`
+	MaxOutputBytes          int64             `mapstructure:"maxOutputBytes" desc:"Most bytes of output passed on from a session, the rest is dropped after a marker (0 is no limit)"`
+	TimestampOutput         bool              `mapstructure:"timestampOutput" desc:"Start every line of the output with the local time it arrived"`
+	TimestampFormat         string            `mapstructure:"timestampFormat" default:"2006-01-02T15:04:05Z07:00" desc:"Layout of the timestampOutput times, in the notation of Go's time package (RFC 3339 by default)"`
+	MaxLogBytes             int64             `mapstructure:"maxLogBytes" desc:"Bytes of the output of a session written to the log at most (0 for no limit), the output itself is not cut"`
+	RetryOnOutputMatch      string            `mapstructure:"retryOnOutputMatch" desc:"Retry a failed exec mode command when its output matches this regex"`
+	ExpectOutput            string            `mapstructure:"expectOutput" desc:"Regex the output (stdout and stderr) has to match, the run fails otherwise"`
+	RetryCount              int               `mapstructure:"retryCount" default:"3" desc:"Retries of a failed command matching retryOnOutputMatch"`
+	ForwardSignals          []string          `mapstructure:"forwardSignals" desc:"Local signals relayed to the remote session (INT, TERM, HUP, QUIT, USR1, USR2)"`
+	SendEnv                 []string          `mapstructure:"sendEnv" desc:"Local environment variables passed on to the session, as names or patterns like LC_*"`
+	NoMoreSessions          bool              `mapstructure:"noMoreSessions" desc:"Tell the server to refuse any further sessions once the session is open"`
+	ExpectedHostname        string            `mapstructure:"expectedHostname" desc:"Name the remote host has to report with hostname, or the engine stops"`
+	SuppressMotd            bool              `mapstructure:"suppressMotd" desc:"Create ~/.hushlogin on the remote, so logins don't print the message of the day"`
+	GatherFacts             bool              `mapstructure:"gatherFacts" desc:"Log uname and os-release of the remote host after connecting"`
+	Uploads                 []Transfer        `mapstructure:"uploads" desc:"Files copied to the remote over SFTP after connecting, as local and remote paths"`
+	Downloads               []Transfer        `mapstructure:"downloads" desc:"Files copied from the remote over SFTP after connecting, as remote and local paths"`
+	SyncDir                 SyncDir           `mapstructure:"syncDir" desc:"Local directory mirrored to the remote over SFTP after connecting, as local, remote and delete"`
+	TransferConcurrency     int               `mapstructure:"transferConcurrency" default:"4" desc:"Number of uploads and downloads run at the same time"`
+	HostConcurrency         int               `mapstructure:"hostConcurrency" default:"4" desc:"Number of hosts run at the same time with --hosts-from"`
+	OutputDir               string            `mapstructure:"outputDir" desc:"Directory the output of each host is written to with --hosts-from, with an index of exit codes"`
+	CompressOutput          bool              `mapstructure:"compressOutput" desc:"Compress the files of outputDir with gzip, as <host>.log.gz"`
+	LocalForwards           []string          `mapstructure:"localForwards" desc:"Local ports forwarded to the remote side, as [bind:]port:host:hostport"`
+	RemoteForwards          []string          `mapstructure:"remoteForwards" desc:"Remote ports forwarded to the local side, as [bind:]port:host:hostport"`
+	LocalCommand            string            `mapstructure:"localCommand" desc:"Local command run once connected and the forwards are up, with their ports in SSH_ENGINE_LOCAL_PORTS and SSH_ENGINE_REMOTE_PORTS"`
+	BannerTimeout           int               `mapstructure:"bannerTimeout" desc:"Seconds the server gets to send its SSH banner once connected, 0 waits forever"`
+	TcpKeepAlive            int               `mapstructure:"tcpKeepAlive" default:"15" desc:"Seconds between TCP keepalives of the connection, negative turns them off"`
+	ServerAliveInterval     int               `mapstructure:"serverAliveInterval" desc:"Seconds between keepalives, the connection is closed when one fails"`
+	ServerAliveCountMax     int               `mapstructure:"serverAliveCountMax" default:"3" desc:"Keepalives in a row that may go unanswered before the connection is closed"`
+	Daemon                  bool              `mapstructure:"daemon" desc:"Only hold the forwards open, without a session, until stopped"`
+	PidFile                 string            `mapstructure:"pidFile" desc:"File the process ID is written to in daemon mode"`
+	FallbackHosts           []string          `mapstructure:"fallbackHosts" desc:"Hosts (optionally host:port) tried in order when the host can't be reached"`
+	RaceHosts               bool              `mapstructure:"raceHosts" desc:"Connect to the host and the fallbackHosts at once, using the first that authenticates"`
+	WebsocketURL            string            `mapstructure:"websocketURL" desc:"WebSocket (ws:// or wss://) the SSH connection is tunnelled through, instead of host"`
+	Profiles                profileMap        `mapstructure:"profiles" desc:"Named sets of settings overriding the others, selected with --profile"`
+}
+
+// profileMap holds the settings of each profile by the profile name
+type profileMap map[string]map[string]interface{}
+
+// configurationKey describes one supported key of engine.yml
+type configurationKey struct {
+	Name        string
+	Type        string
+	Default     string
+	Description string
+}
+
+func getConfigurationKeys() []configurationKey {
+	var keys []configurationKey
+	t := reflect.TypeOf(Configurations{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		keys = append(keys, configurationKey{
+			Name:        field.Tag.Get("mapstructure"),
+			Type:        strings.ReplaceAll(field.Type.String(), "main.", ""),
+			Default:     field.Tag.Get("default"),
+			Description: field.Tag.Get("desc"),
+		})
+	}
+
+	return keys
+}
+
+// printConfiguration writes the settings in effect as YAML, after the
+// defaults, the profile and the command line are applied. Secrets are only
+// shown as set or not.
+func printConfiguration(configuration Configurations) error {
+	var settings yaml.MapSlice
+	v := reflect.ValueOf(configuration)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "profiles" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value = "<redacted>"
+		}
+		settings = append(settings, yaml.MapItem{Key: name, Value: value})
+	}
+
+	buf, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func setConfigurationDefaults() {
+	for _, key := range getConfigurationKeys() {
+		if key.Default != "" {
+			viper.SetDefault(key.Name, key.Default)
+		}
+	}
+}
+
+func printSchema() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tTYPE\tDEFAULT\tDESCRIPTION")
+	for _, key := range getConfigurationKeys() {
+		def := key.Default
+		if def == "" {
+			def = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Name, key.Type, def, key.Description)
+	}
+	w.Flush()
+}
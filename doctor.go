@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+// doctorReport prints the result of each check as it is made, in color on
+// a terminal.
+type doctorReport struct {
+	color    bool
+	failures int
+}
+
+func (r *doctorReport) add(status checkStatus, name string, format string, args ...interface{}) {
+	labels := []string{"[ OK ]", "[WARN]", "[FAIL]"}
+	colors := []string{"\x1b[32m", "\x1b[33m", "\x1b[31m"}
+
+	label := labels[status]
+	if r.color {
+		label = colors[status] + label + "\x1b[0m"
+	}
+	fmt.Printf("%s %s: %s\n", label, name, fmt.Sprintf(format, args...))
+
+	if status == checkFail {
+		r.failures++
+	}
+}
+
+// runDoctor checks the configuration, the key and the host key verification
+// without connecting, and returns whether everything needed is in order.
+func runDoctor(configuration Configurations) bool {
+	report := &doctorReport{}
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		if restore, err := enableVirtualTerminal(); err == nil {
+			defer restore()
+			report.color = true
+		}
+	}
+
+	// readConfiguration has already stopped on anything it couldn't accept
+	report.add(checkOK, "Configuration", "engine.yml read")
+
+	// Nothing is opened that could reach out, neither the agent nor the KDC.
+	// The warnings logged on the way become part of the report.
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	log.SetFlags(0)
+	err := applySshSettings(&ssh.ClientConfig{}, configuration)
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+
+	for _, line := range strings.Split(strings.TrimSpace(warnings.String()), "\n") {
+		if line != "" {
+			report.add(checkWarn, "SSH settings", "%s", line)
+		}
+	}
+	if err != nil {
+		report.add(checkFail, "SSH settings", "%s", err)
+	} else {
+		report.add(checkOK, "SSH settings", "options and rekeyThreshold accepted")
+	}
+
+	names, _ := getAuthMethodNames(configuration)
+	if len(names) == 0 {
+		if isTerminal() {
+			report.add(checkWarn, "Authentication", "no method configured, the password is asked for on the terminal")
+		} else {
+			report.add(checkFail, "Authentication", "no method configured, set one of privateKeyFile, useAgent, password or kerberos")
+		}
+	}
+	for _, name := range names {
+		if err := checkAuthMethod(name, configuration); err != nil {
+			// Like when connecting, unavailable Kerberos or agent is skipped
+			status := checkFail
+			if name == "kerberos" || name == "agent" {
+				status = checkWarn
+			}
+			report.add(status, "Authentication", "%s: %s", name, err)
+		} else {
+			report.add(checkOK, "Authentication", "%s", name)
+		}
+	}
+
+	var permissionErr error
+	if configuration.PrivateKeyFile != "" {
+		permissionErr = checkKeyFilePermissions(configuration.PrivateKeyFile)
+	}
+	if file := configuration.PrivateKeyFile; file != "" {
+		if err := permissionErr; err != nil {
+			status := checkWarn
+			if configuration.StrictPermissions {
+				status = checkFail
+			}
+			report.add(status, "Key file permissions", "%s", err)
+		} else {
+			report.add(checkOK, "Key file permissions", "%s can only be read by its owner", file)
+		}
+
+		if key, err := getKeyFile(file, configuration.PrivateKeyPassphrase); err != nil {
+			report.add(checkFail, "Private key", "%s", err)
+		} else {
+			report.add(checkOK, "Private key", "%s %s", key.PublicKey().Type(), getFingerprint(key.PublicKey(), configuration.FingerprintHash))
+		}
+	}
+
+	if command := configuration.HostKeyVerifierCommand; command != "" {
+		if _, err := exec.LookPath(strings.Fields(command)[0]); err != nil {
+			report.add(checkFail, "Host key verification", "hostKeyVerifierCommand %s: %s", command, err)
+		} else {
+			report.add(checkOK, "Host key verification", "done by %s", command)
+		}
+	} else if configuration.StrictHostKeyChecking == "no" {
+		report.add(checkWarn, "Host key verification", "strictHostKeyChecking is no, any host key is accepted")
+	} else {
+		checkKnownHostsFiles(report, configuration)
+		if configuration.VerifySshfp {
+			if server, err := getDnsServer(configuration.DnsServer); err != nil {
+				report.add(checkFail, "SSHFP records", "%s", err)
+			} else {
+				report.add(checkOK, "SSHFP records", "looked up with %s", server)
+			}
+		}
+	}
+
+	if file := configuration.RemoteScriptFile; file != "" {
+		if _, err := os.Stat(file); err != nil {
+			report.add(checkFail, "Remote script", "%s", err)
+		} else {
+			report.add(checkOK, "Remote script", "%s found", file)
+		}
+	}
+
+	return report.failures == 0
+}
+
+// checkKnownHostsFiles looks for the known_hosts files. Without any, yes
+// refuses every host, and ask every host without a terminal.
+func checkKnownHostsFiles(report *doctorReport, configuration Configurations) {
+	files := getKnownHostsFiles(configuration)
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		} else if !os.IsNotExist(err) {
+			report.add(checkFail, "Host key verification", "%s", err)
+			return
+		}
+	}
+
+	mode := configuration.StrictHostKeyChecking
+	if len(existing) == 0 {
+		if mode == "yes" {
+			report.add(checkFail, "Host key verification", "none of %s exists, strictHostKeyChecking yes refuses every host", strings.Join(files, " and "))
+		} else {
+			report.add(checkWarn, "Host key verification", "none of %s exists, strictHostKeyChecking ask refuses every host until one is confirmed on a terminal", strings.Join(files, " and "))
+		}
+		return
+	}
+	report.add(checkOK, "Host key verification", "against %s, strictHostKeyChecking %s", strings.Join(existing, " and "), mode)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sendEnv passes the local environment variables whose names match one of
+// the patterns on to the session, like OpenSSH's SendEnv. The server only
+// takes the ones its AcceptEnv allows, a refused one is logged and left out.
+func sendEnv(session *ssh.Session, patterns []string) {
+	env := os.Environ()
+	sort.Strings(env)
+
+	for _, entry := range env {
+		name, value := entry, ""
+		if i := strings.Index(entry, "="); i > 0 {
+			name, value = entry[:i], entry[i+1:]
+		}
+		if !matchesEnvPattern(name, patterns) {
+			continue
+		}
+		if err := session.Setenv(name, value); err != nil {
+			log.Printf("The server refused the environment variable %s, it may need to be in AcceptEnv", name)
+		} else if debugLogging {
+			log.Printf("Sent the environment variable %s", name)
+		}
+	}
+}
+
+func matchesEnvPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
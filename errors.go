@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The categories failures are reported under, errors.Is tells them apart
+var (
+	errAuth       = errors.New("auth")
+	errNetwork    = errors.New("network")
+	errConfig     = errors.New("config")
+	errRemoteExit = errors.New("remote-exit")
+	errTimeout    = errors.New("timeout")
+	errLocal      = errors.New("local")
+)
+
+// jsonOutput is set with --output json, for wrappers that want to branch on
+// the kind of failure rather than parse log lines
+var jsonOutput bool
+
+// engineError is a failure of the run, with the category it falls under
+type engineError struct {
+	category error
+	message  string
+	err      error
+}
+
+func (e *engineError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *engineError) Unwrap() error {
+	return e.err
+}
+
+func (e *engineError) Is(target error) bool {
+	return target == e.category
+}
+
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []*exitHook
+)
+
+type exitHook struct {
+	run func()
+}
+
+// atExit adds a function run before fatal exits, for what the deferred
+// calls would otherwise have written out. The hook of a session is removed
+// with the function returned once the session is over, as fatal may run on
+// another goroutine at any time.
+func atExit(hook func()) func() {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	h := &exitHook{run: hook}
+	exitHooks = append(exitHooks, h)
+
+	return func() {
+		exitHooksMu.Lock()
+		defer exitHooksMu.Unlock()
+		for i, e := range exitHooks {
+			if e == h {
+				exitHooks = append(exitHooks[:i], exitHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func runExitHooks() {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	for _, hook := range exitHooks {
+		hook.run()
+	}
+}
+
+// fatalExitStatus is the status fatal exits with. With quietExit it is 255,
+// like ssh, so the failures of the engine don't pass for the remote status.
+var fatalExitStatus = 1
+
+// fatal reports the failure and exits with fatalExitStatus. With --output
+// json the report is a JSON object on stderr, stdout being the engine
+// protocol channel, otherwise it is logged like any other error.
+func fatal(category error, message string, err error) {
+	e := &engineError{category: category, message: message, err: err}
+	runExitHooks()
+	if !jsonOutput {
+		log.Print(e)
+		os.Exit(fatalExitStatus)
+	}
+
+	report := struct {
+		Category string `json:"category"`
+		Message  string `json:"message"`
+		Error    string `json:"error,omitempty"`
+	}{Category: category.Error(), Message: message}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	json.NewEncoder(os.Stderr).Encode(report)
+	os.Exit(fatalExitStatus)
+}
+
+// getDialErrorCategory sorts out why connecting failed. The ssh package
+// only has the text of a failed authentication, so that one is matched on.
+func getDialErrorCategory(err error) error {
+	var netErr interface{ Timeout() bool }
+	if errors.Is(err, errBannerTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errTimeout
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") || isHostKeyRejection(err) {
+		return errAuth
+	}
+	return errNetwork
+}
+
+// isHostKeyRejection tells whether the handshake failed on the host key,
+// in any of the ways it can be checked
+func isHostKeyRejection(err error) bool {
+	for _, rejection := range []error{errHostKeyUnknown, errHostKeyChanged, errHostKeyRevoked, errHostKeyNotAccepted, errHostKeyVerifierRejected} {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// escapeWriter passes the keys typed in interactive mode on to w, except
+// for OpenSSH style escape sequences: the escape character at the start of
+// a line, followed by a command character.
+type escapeWriter struct {
+	w            io.Writer
+	escape       byte
+	lineStart    bool
+	pending      bool
+	forwards     []string
+	onDisconnect func()
+}
+
+func newEscapeWriter(w io.Writer, escape byte, forwards []string, onDisconnect func()) *escapeWriter {
+	return &escapeWriter{
+		w:            w,
+		escape:       escape,
+		lineStart:    true,
+		forwards:     forwards,
+		onDisconnect: onDisconnect,
+	}
+}
+
+func (e *escapeWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch {
+		case e.pending:
+			e.pending = false
+			switch b {
+			case '.':
+				e.print("Connection closed.")
+				e.onDisconnect()
+				return len(p), nil
+			case '?':
+				e.printHelp()
+				continue
+			case '#':
+				e.printForwards()
+				continue
+			case e.escape:
+				out = append(out, b)
+			default:
+				// Not a command, so both go to the remote as typed
+				out = append(out, e.escape, b)
+			}
+		case e.lineStart && b == e.escape:
+			e.pending = true
+			continue
+		default:
+			out = append(out, b)
+		}
+		e.lineStart = b == '\r' || b == '\n'
+	}
+
+	if _, err := e.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// print writes to the local terminal, which is in raw mode, so lines need a
+// carriage return too
+func (e *escapeWriter) print(lines ...string) {
+	fmt.Fprint(os.Stderr, "\r\n"+strings.Join(lines, "\r\n")+"\r\n")
+}
+
+func (e *escapeWriter) printHelp() {
+	c := string(e.escape)
+	e.print(
+		"Supported escape sequences:",
+		" "+c+".   - terminate the connection",
+		" "+c+"#   - list forwarded ports",
+		" "+c+"?   - this message",
+		" "+c+c+"   - send the escape character",
+		"(Note that escapes are only recognized immediately after a newline.)",
+	)
+}
+
+func (e *escapeWriter) printForwards() {
+	if len(e.forwards) == 0 {
+		e.print("No forwarded ports.")
+		return
+	}
+	e.print(append([]string{"Forwarded ports:"}, e.forwards...)...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ExpectRule answers a prompt in the remote output
+type ExpectRule struct {
+	Expect  string `mapstructure:"expect"`
+	Send    string `mapstructure:"send"`
+	Timeout int    `mapstructure:"timeout"`
+}
+
+type compiledExpectRule struct {
+	pattern *regexp.Regexp
+	send    string
+	timeout time.Duration
+}
+
+// expecter watches the remote output for the rules one after the other, and
+// sends the answer of a rule as soon as its pattern shows up. It
+// matches on partial lines too, prompts usually don't end with a newline.
+// Once an answer can't be sent, no more rules are matched.
+type expecter struct {
+	mu      sync.Mutex
+	rules   []compiledExpectRule
+	current int
+	send    func(line string) error
+	buf     []byte
+	matched chan struct{}
+	failed  chan error
+	done    chan struct{}
+}
+
+func newExpecter(rules []ExpectRule, send func(line string) error) (*expecter, error) {
+	e := &expecter{
+		send:    send,
+		matched: make(chan struct{}, len(rules)),
+		failed:  make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect pattern %q: %w", rule.Expect, err)
+		}
+		e.rules = append(e.rules, compiledExpectRule{
+			pattern: pattern,
+			send:    rule.Send,
+			timeout: time.Duration(rule.Timeout) * time.Second,
+		})
+	}
+
+	return e, nil
+}
+
+func (e *expecter) watch(p []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current == len(e.rules) {
+		return
+	}
+
+	e.buf = append(e.buf, p...)
+	for e.current < len(e.rules) {
+		rule := e.rules[e.current]
+		match := rule.pattern.FindIndex(e.buf)
+		if match == nil {
+			break
+		}
+		if err := e.send(rule.send); err != nil {
+			e.current = len(e.rules)
+			e.buf = nil
+			e.failed <- fmt.Errorf("could not answer %q: %w", rule.pattern.String(), err)
+			return
+		}
+		e.buf = e.buf[match[1]:]
+		e.current++
+		e.matched <- struct{}{}
+	}
+	if len(e.buf) > maxLineLength {
+		e.buf = e.buf[len(e.buf)-maxLineLength:]
+	}
+}
+
+// run keeps track of the timeouts of the rules, calling onFailure when a
+// pattern didn't show up in time or its answer couldn't be sent. The done
+// channel is closed once all rules are answered or one failed.
+func (e *expecter) run(onFailure func(category error, reason string)) {
+	defer close(e.done)
+
+	for _, rule := range e.rules {
+		var timeout <-chan time.Time
+		if rule.timeout > 0 {
+			timeout = time.After(rule.timeout)
+		}
+
+		select {
+		case <-e.matched:
+		case err := <-e.failed:
+			onFailure(errNetwork, fmt.Sprintf("Expect rule failed, %s", err))
+			return
+		case <-timeout:
+			onFailure(errTimeout, fmt.Sprintf("Timed out waiting for %q", rule.pattern.String()))
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// factsCommand prints uname first, then os-release where the remote has one
+const factsCommand = "uname -a; cat /etc/os-release 2>/dev/null"
+
+// remoteFacts describes the remote host, as far as gatherFacts found out
+type remoteFacts struct {
+	uname     string
+	osRelease map[string]string
+}
+
+func gatherFacts(client *ssh.Client) (*remoteFacts, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("could not create a session: %w", err)
+	}
+	defer session.Close()
+
+	output, err := session.Output(factsCommand)
+	if err != nil {
+		return nil, fmt.Errorf("could not run %q: %w", factsCommand, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	facts := &remoteFacts{
+		uname:     strings.TrimSpace(lines[0]),
+		osRelease: make(map[string]string),
+	}
+	for _, line := range lines[1:] {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			facts.osRelease[parts[0]] = strings.Trim(parts[1], `"'`)
+		}
+	}
+
+	return facts, nil
+}
+
+func (f *remoteFacts) String() string {
+	s := "Remote host: " + f.uname
+	if name := f.osRelease["PRETTY_NAME"]; name != "" {
+		s += ", " + name
+	}
+	return s
+}
+
+// env returns the facts as environment variables for the local commands
+func (f *remoteFacts) env() []string {
+	return []string{
+		"SSH_ENGINE_REMOTE_UNAME=" + f.uname,
+		"SSH_ENGINE_REMOTE_OS_ID=" + f.osRelease["ID"],
+		"SSH_ENGINE_REMOTE_OS_VERSION_ID=" + f.osRelease["VERSION_ID"],
+	}
+}
+
+// checkHostname makes sure the remote is the host it is supposed to be, by
+// its own account. Expected may be the short name of the host as well.
+func checkHostname(client *ssh.Client, expected string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("could not create a session: %w", err)
+	}
+	defer session.Close()
+
+	output, err := session.Output("hostname")
+	if err != nil {
+		return fmt.Errorf("could not run hostname: %w", err)
+	}
+
+	actual := strings.TrimSpace(string(output))
+	if strings.EqualFold(actual, expected) || strings.EqualFold(strings.SplitN(actual, ".", 2)[0], expected) {
+		return nil
+	}
+	return fmt.Errorf("the remote calls itself %s, expected %s", actual, expected)
+}
+
+// hushLogin creates ~/.hushlogin on the remote, which keeps the login from
+// printing the message of the day and the last login, also for the session
+// opened after it.
+func hushLogin(client *ssh.Client) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("could not create a session: %w", err)
+	}
+	defer session.Close()
+
+	if output, err := session.CombinedOutput("touch ~/.hushlogin"); err != nil {
+		return fmt.Errorf("could not create ~/.hushlogin: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// readHostList reads the hosts, one per line, from the file or from stdin
+// for -. Blank lines and comments starting with # are skipped.
+func readHostList(source string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+
+	return hosts, scanner.Err()
+}
+
+// runHostsFrom runs the engine again for every host of the list, with the
+// same arguments but --host, at most hostConcurrency at a time. The output
+// lines are prefixed with the host they came from, and with an outputDir
+// also written to a file per host. An interrupt is passed on to the hosts
+// that run, and the files are closed once they stop, so compressed ones
+// aren't cut short. It returns the hosts that failed.
+func runHostsFrom(hosts []string, args []string, configuration Configurations) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args = removeFlag(removeFlag(args, "--hosts-from"), "--host")
+
+	if configuration.OutputDir != "" {
+		if err := os.MkdirAll(configuration.OutputDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	concurrency := configuration.HostConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	exitCodes := make([]int, len(hosts))
+
+	var runningMu sync.Mutex
+	running := make(map[*exec.Cmd]bool)
+	stopping := false
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(stop)
+		close(stop)
+	}()
+	go func() {
+		sig, ok := <-stop
+		if !ok {
+			return
+		}
+		// Another interrupt stops the engine right away, as before
+		signal.Stop(stop)
+		log.Printf("Stopping the hosts on %s", sig)
+		runningMu.Lock()
+		defer runningMu.Unlock()
+		stopping = true
+		for cmd := range running {
+			if err := cmd.Process.Signal(sig); err != nil {
+				cmd.Process.Kill()
+			}
+		}
+	}()
+
+	for i, host := range hosts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var file io.Writer = ioutil.Discard
+			if configuration.OutputDir != "" {
+				f, err := createHostOutputFile(getHostOutputFile(configuration.OutputDir, host, configuration.CompressOutput), configuration.CompressOutput)
+				if err != nil {
+					log.Printf("Not running %s: %v", host, err)
+					exitCodes[i] = -1
+					return
+				}
+				defer func() {
+					if err := f.Close(); err != nil {
+						log.Printf("Failed to write the output of %s: %v", host, err)
+					}
+				}()
+				// os/exec copies stdout and stderr on goroutines of their own,
+				// and a gzip stream can only take one write at a time
+				file = &lockedWriter{w: f}
+			}
+
+			stdout := newPrefixWriter(file, os.Stdout, host, &mu)
+			stderr := newPrefixWriter(file, os.Stderr, host, &mu)
+			cmd := exec.Command(self, append(args, "--host", host)...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+
+			runningMu.Lock()
+			if stopping {
+				runningMu.Unlock()
+				exitCodes[i] = -1
+				return
+			}
+			err := cmd.Start()
+			if err == nil {
+				running[cmd] = true
+			}
+			runningMu.Unlock()
+			if err == nil {
+				err = cmd.Wait()
+				runningMu.Lock()
+				delete(running, cmd)
+				runningMu.Unlock()
+			}
+			stdout.Flush()
+			stderr.Flush()
+
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCodes[i] = exitErr.ExitCode()
+			} else if err != nil {
+				log.Printf("Failed to run %s: %v", host, err)
+				exitCodes[i] = -1
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	var failed []string
+	var index strings.Builder
+	for i, host := range hosts {
+		if exitCodes[i] != 0 {
+			failed = append(failed, host)
+		}
+		fmt.Fprintf(&index, "%s\t%d\n", host, exitCodes[i])
+	}
+	if configuration.OutputDir != "" {
+		if err := ioutil.WriteFile(filepath.Join(configuration.OutputDir, "index.txt"), []byte(index.String()), 0644); err != nil {
+			return failed, err
+		}
+	}
+
+	return failed, nil
+}
+
+// getHostOutputFile names the output file of the host, with the characters
+// a file name can't hold everywhere replaced. Compressed files end in .gz.
+func getHostOutputFile(dir string, host string, compress bool) string {
+	name := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_", "\\", "_").Replace(host) + ".log"
+	if compress {
+		name += ".gz"
+	}
+	return filepath.Join(dir, name)
+}
+
+// createHostOutputFile creates the output file of a host, compressed with
+// gzip if asked to. Nothing is complete until it is closed.
+func createHostOutputFile(name string, compress bool) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return f, nil
+	}
+	return &gzipFile{Writer: gzip.NewWriter(f), file: f}, nil
+}
+
+// gzipFile is a file written through gzip. Close ends the gzip stream and
+// then closes the file.
+type gzipFile struct {
+	*gzip.Writer
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lockedWriter lets one write to w through at a time
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
+
+// newPrefixWriter passes everything on to file, and writes every line to w
+// with the host in front, taking mu so lines of different hosts don't mix.
+func newPrefixWriter(file io.Writer, w io.Writer, host string, mu *sync.Mutex) *lineWriter {
+	return newLineWriter(file, func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "%s: %s\n", host, line)
+	})
+}
+
+// applyHostFlag points the configuration to the host given with --host,
+// which may come with a user and a port. Only the parts given override the
+// configured ones.
+func applyHostFlag(configuration *Configurations, host string) {
+	user, host, port := parseHostString(host)
+	if host != "" {
+		configuration.Host = host
+	}
+	if user != "" {
+		configuration.User = user
+	}
+	if port != "" {
+		configuration.Port = port
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultDaemonAliveInterval is the keepalive interval in daemon mode when
+// serverAliveInterval is not set, so a dead connection is noticed at all.
+const defaultDaemonAliveInterval = 30
+
+// parseForward splits a forward in the OpenSSH format [bind:]port:host:hostport
+// into the address listened on and the address connected to.
+func parseForward(spec string) (string, string, error) {
+	// IPv6 addresses are given in brackets, so split around those first
+	var parts []string
+	for rest := spec; rest != ""; {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", "", fmt.Errorf("invalid forward %q, missing ]", spec)
+			}
+			parts = append(parts, rest[1:end])
+			rest = strings.TrimPrefix(rest[end+1:], ":")
+			continue
+		}
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			parts = append(parts, rest)
+			break
+		}
+		parts = append(parts, rest[:i])
+		rest = rest[i+1:]
+	}
+
+	bind := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bind, parts = parts[0], parts[1:]
+	default:
+		return "", "", fmt.Errorf("invalid forward %q, expected [bind:]port:host:hostport", spec)
+	}
+	for _, port := range []string{parts[0], parts[2]} {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid port %q in forward %q", port, spec)
+		}
+	}
+
+	return net.JoinHostPort(bind, parts[0]), net.JoinHostPort(parts[1], parts[2]), nil
+}
+
+// startLocalForward listens locally and connects every connection through
+// the SSH connection to the target, like ssh -L. It returns the address
+// listened on, which has the port picked when the spec asked for port 0.
+func startLocalForward(client *ssh.Client, spec string) (string, error) {
+	listen, target, err := parseForward(spec)
+	if err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return "", fmt.Errorf("could not listen on %s: %w", listen, err)
+	}
+
+	go serveForward(listener, target, client.Dial)
+	return listener.Addr().String(), nil
+}
+
+// startRemoteForward has the server listen and connects every connection to
+// the target on the local side, like ssh -R. It returns the address the
+// server listens on.
+func startRemoteForward(client *ssh.Client, spec string) (string, error) {
+	listen, target, err := parseForward(spec)
+	if err != nil {
+		return "", err
+	}
+	listener, err := client.Listen("tcp", listen)
+	if err != nil {
+		return "", fmt.Errorf("could not listen on %s on the remote: %w", listen, err)
+	}
+
+	go serveForward(listener, target, net.Dial)
+	return listener.Addr().String(), nil
+}
+
+// getForwardEnv describes the ports listened on for the local command, in
+// the order of the forwards
+func getForwardEnv(localAddresses []string, remoteAddresses []string) []string {
+	ports := func(addresses []string) string {
+		var ports []string
+		for _, address := range addresses {
+			if _, port, err := net.SplitHostPort(address); err == nil {
+				ports = append(ports, port)
+			}
+		}
+		return strings.Join(ports, " ")
+	}
+
+	env := []string{
+		"SSH_ENGINE_LOCAL_PORTS=" + ports(localAddresses),
+		"SSH_ENGINE_REMOTE_PORTS=" + ports(remoteAddresses),
+	}
+	if len(localAddresses) > 0 {
+		env = append(env, "SSH_ENGINE_LOCAL_PORT="+ports(localAddresses[:1]))
+	}
+	return env
+}
+
+func serveForward(listener net.Listener, target string, dial func(network, address string) (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			remote, err := dial("tcp", target)
+			if err != nil {
+				log.Printf("Could not forward a connection to %s: %s", target, err)
+				return
+			}
+			defer remote.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(remote, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, remote)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// serverUnresponsive is set once keepAlive closed the connection because
+// the server stopped answering, so the session can tell why it ended.
+var serverUnresponsive int32
+
+// errNoResponse is returned when a keepalive isn't answered in time
+var errNoResponse = errors.New("no response from server")
+
+// keepAlive sends a keepalive request every interval and closes the
+// connection once countMax of them in a row went unanswered, so waiting on
+// it ends even when the connection died without the network telling. A
+// reply that hasn't come by the time the next keepalive is due is a miss.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int) {
+	misses := 0
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := sendKeepAlive(client, interval)
+		if err == nil {
+			misses = 0
+			continue
+		}
+		if err != errNoResponse {
+			log.Printf("Keepalive failed, closing the connection: %s", err)
+			client.Close()
+			return
+		}
+
+		misses++
+		if misses < countMax {
+			log.Printf("No reply to keepalive (%d of %d)", misses, countMax)
+			continue
+		}
+		log.Printf("No response from server to %d keepalives, closing the connection", misses)
+		atomic.StoreInt32(&serverUnresponsive, 1)
+		client.Close()
+		return
+	}
+}
+
+// sendKeepAlive sends a keepalive request and waits up to timeout for the
+// reply. A connection that died silently never replies, nor fails.
+func sendKeepAlive(client *ssh.Client, timeout time.Duration) error {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	select {
+	case err := <-replied:
+		return err
+	case <-time.After(timeout):
+		return errNoResponse
+	}
+}
+
+// runProxyStdio connects the local stdin and stdout to target, as seen from
+// the server, for the engine to be the ProxyCommand of another SSH client.
+// The end of stdin is passed on, and it returns once the remote is done.
+func runProxyStdio(client *ssh.Client, target string) error {
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", target, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runDaemon keeps the connection with its forwards up, without a session,
+// until the process is told to stop or the connection is lost.
+func runDaemon(client *ssh.Client, configuration Configurations) error {
+	if configuration.PidFile != "" {
+		if err := ioutil.WriteFile(configuration.PidFile, []byte(fmt.Sprintln(os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("could not write the pid file: %w", err)
+		}
+		defer os.Remove(configuration.PidFile)
+	}
+
+	if configuration.ServerAliveInterval == 0 {
+		go keepAlive(client, defaultDaemonAliveInterval*time.Second, configuration.ServerAliveCountMax)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	lost := make(chan error, 1)
+	go func() {
+		lost <- client.Wait()
+	}()
+
+	select {
+	case sig := <-stop:
+		log.Printf("Stopping on %s", sig)
+		return nil
+	case err := <-lost:
+		return fmt.Errorf("the connection was lost: %v", err)
+	}
+}
@@ -3,6 +3,14 @@ module ssh-engine
 go 1.16
 
 require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
+	github.com/pkg/sftp v1.13.5
 	github.com/spf13/viper v1.8.0
 	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
+	golang.org/x/term v0.5.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// kexInitMsg is the SSH_MSG_KEXINIT each side opens the handshake with,
+// listing the algorithms it supports in order of preference.
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// kexInitReader picks the KEXINIT out of one direction of the stream. It
+// is the first packet after the version line, and goes out before anything
+// is encrypted.
+type kexInitReader struct {
+	mu          sync.Mutex
+	buf         []byte
+	version     string
+	versionSeen bool
+	done        bool
+	msg         *kexInitMsg
+}
+
+func (r *kexInitReader) feed(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	r.buf = append(r.buf, p...)
+
+	// Servers may send other lines before their version line
+	for !r.versionSeen {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			return
+		}
+		if bytes.HasPrefix(r.buf, []byte("SSH-")) {
+			r.versionSeen = true
+			r.version = strings.TrimRight(string(r.buf[:i]), "\r")
+		}
+		r.buf = r.buf[i+1:]
+	}
+
+	if len(r.buf) < 5 {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(r.buf))
+	padding := int(r.buf[4])
+	if length > 256*1024 || padding+1 > length {
+		r.done = true
+		return
+	}
+	if len(r.buf) < 4+length {
+		return
+	}
+
+	var msg kexInitMsg
+	if err := ssh.Unmarshal(r.buf[5:4+length-padding], &msg); err == nil {
+		r.msg = &msg
+	}
+	r.done = true
+	r.buf = nil
+}
+
+func (r *kexInitReader) get() *kexInitMsg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.msg
+}
+
+func (r *kexInitReader) getVersion() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.version
+}
+
+// errBannerTimeout tells a server that took the connection but never sent
+// its version line apart from one that can't be reached at all
+var errBannerTimeout = errors.New("no SSH banner from the server")
+
+// kexInitConn records the KEXINIT messages going either way. Until the
+// server has sent its version line, reads time out at bannerDeadline.
+type kexInitConn struct {
+	net.Conn
+	client         kexInitReader
+	server         kexInitReader
+	bannerDeadline time.Time
+}
+
+func (c *kexInitConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.server.feed(p[:n])
+	if !c.bannerDeadline.IsZero() && c.server.getVersion() != "" {
+		c.bannerDeadline = time.Time{}
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// startBannerTimeout makes reads fail once the timeout passes without the
+// version line of the server. A timeout of 0 waits forever.
+func (c *kexInitConn) startBannerTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		c.bannerDeadline = time.Now().Add(timeout)
+		c.Conn.SetReadDeadline(c.bannerDeadline)
+	}
+}
+
+// bannerTimedOut tells whether the handshake failed waiting for the version
+// line of the server
+func (c *kexInitConn) bannerTimedOut() bool {
+	return !c.bannerDeadline.IsZero() && c.server.getVersion() == "" && !time.Now().Before(c.bannerDeadline)
+}
+
+func (c *kexInitConn) Write(p []byte) (int, error) {
+	c.client.feed(p)
+	return c.Conn.Write(p)
+}
+
+// connectionInfo describes what the handshake settled on
+type connectionInfo struct {
+	address         string
+	serverVersion   string
+	hostKey         ssh.PublicKey
+	fingerprintHash string
+	client          *kexInitMsg
+	server          *kexInitMsg
+}
+
+// getNegotiated returns the algorithm the handshake picks from the lists:
+// the first of the client that the server supports as well.
+func getNegotiated(client []string, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return "none"
+}
+
+func getNegotiatedMAC(cipher string, client []string, server []string) string {
+	// AEAD ciphers authenticate the packets themselves
+	if strings.Contains(cipher, "gcm") || strings.HasPrefix(cipher, "chacha20-poly1305") {
+		return "implicit"
+	}
+	return getNegotiated(client, server)
+}
+
+func (info *connectionInfo) String() string {
+	summary := fmt.Sprintf("Connected to %s (%s)", info.address, info.serverVersion)
+	if info.hostKey != nil {
+		summary += fmt.Sprintf(", host key %s %s", info.hostKey.Type(), getFingerprint(info.hostKey, info.fingerprintHash))
+	}
+	if info.client == nil || info.server == nil {
+		return summary
+	}
+
+	c, s := info.client, info.server
+	kex := getNegotiated(c.KexAlgos, s.KexAlgos)
+	cipherOut := getNegotiated(c.CiphersClientServer, s.CiphersClientServer)
+	cipherIn := getNegotiated(c.CiphersServerClient, s.CiphersServerClient)
+	macOut := getNegotiatedMAC(cipherOut, c.MACsClientServer, s.MACsClientServer)
+	macIn := getNegotiatedMAC(cipherIn, c.MACsServerClient, s.MACsServerClient)
+
+	return summary + fmt.Sprintf(", kex %s, cipher %s, MAC %s", kex, getPair(cipherOut, cipherIn), getPair(macOut, macIn))
+}
+
+// getPair shows both directions, when they differ
+func getPair(out string, in string) string {
+	if out == in {
+		return out
+	}
+	return out + " (out) / " + in + " (in)"
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// runLocalCommand runs command through the local shell. Its output goes to
+// stderr, since stdout is the engine protocol channel.
+func runLocalCommand(command string, env ...string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// expandHome expands a leading ~ to the home directory of the user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// The ways the known_hosts files reject a host key
+var (
+	errHostKeyUnknown     = errors.New("unknown host key")
+	errHostKeyChanged     = errors.New("host key changed")
+	errHostKeyRevoked     = errors.New("revoked host key")
+	errHostKeyNotAccepted = errors.New("host key not accepted")
+)
+
+// getKnownHostsCallback checks host keys against the known_hosts files, as
+// strictHostKeyChecking says: yes rejects hosts that aren't in them, ask
+// asks on the terminal whether to add them. Without a terminal to ask on,
+// like under a chess GUI, ask rejects them like yes does, so nothing is
+// trusted that nobody looked at. New keys go to the first file. A key that
+// differs from the known one is rejected, unless acceptChangedHostKey is
+// set or it is confirmed on the terminal, which replaces the known key.
+// The host key algorithms to ask a server for are returned with the
+// callback.
+func getKnownHostsCallback(configuration Configurations) (ssh.HostKeyCallback, func(address string) []string) {
+	files := getKnownHostsFiles(configuration)
+	mode := configuration.StrictHostKeyChecking
+	algorithms := func(address string) []string {
+		return getKnownHostKeyAlgorithms(files, address)
+	}
+
+	// The files are read again for every connection, so keys added along
+	// the way count
+	var mu sync.Mutex
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var existing []string
+		for _, file := range files {
+			if _, err := os.Stat(file); err == nil {
+				existing = append(existing, file)
+			} else if !os.IsNotExist(err) {
+				return fmt.Errorf("could not read knownHostsFile %s: %w", file, err)
+			}
+		}
+		if len(existing) > 0 {
+			check, err := knownhosts.New(existing...)
+			if err != nil {
+				return fmt.Errorf("could not read knownHostsFile: %w", err)
+			}
+			err = check(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			var revokedErr *knownhosts.RevokedError
+			if errors.As(err, &revokedErr) {
+				known := revokedErr.Revoked
+				return fmt.Errorf("%w: %s %s for %s is revoked in %s:%d", errHostKeyRevoked, key.Type(), getFingerprint(key, configuration.FingerprintHash), hostname, known.Filename, known.Line)
+			}
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				warnHostKeyChanged(hostname, key, keyErr.Want, configuration.FingerprintHash)
+				known := keyErr.Want[0]
+				for _, want := range keyErr.Want {
+					if want.Key.Type() == key.Type() {
+						known = want
+					}
+				}
+				if !acceptChangedHostKey(configuration, hostname) {
+					return fmt.Errorf("%w: %s %s for %s doesn't match the one in %s:%d", errHostKeyChanged, key.Type(), getFingerprint(key, configuration.FingerprintHash), hostname, known.Filename, known.Line)
+				}
+				file, err := replaceKnownHost(keyErr.Want, hostname, key)
+				if err != nil {
+					return err
+				}
+				log.Printf("Replaced the changed host key of %s with %s %s in %s, the old file is kept as %s.old", hostname, key.Type(), getFingerprint(key, configuration.FingerprintHash), file, file)
+				return nil
+			}
+		}
+
+		// The host isn't known yet
+		file := files[0]
+		fingerprint := getFingerprint(key, configuration.FingerprintHash)
+		if mode == "yes" || !isTerminal() {
+			host, port, err := net.SplitHostPort(hostname)
+			if err != nil {
+				host, port = hostname, "22"
+			}
+			reason := "strictHostKeyChecking is yes"
+			if mode != "yes" {
+				reason = "there is no terminal to ask on"
+			}
+			return fmt.Errorf("%w: %s %s for %s is not in %s, and %s, check the key and add it with: ssh-keyscan -p %s %s >> %s", errHostKeyUnknown, key.Type(), fingerprint, hostname, strings.Join(files, " or "), reason, port, host, file)
+		}
+		answer, _ := readTerminalLine(fmt.Sprintf("The authenticity of host %s can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ", hostname, key.Type(), fingerprint), true)
+		if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+			return fmt.Errorf("%w: %s %s for %s", errHostKeyNotAccepted, key.Type(), fingerprint, hostname)
+		}
+
+		if err := addKnownHost(file, hostname, key); err != nil {
+			return err
+		}
+		log.Printf("Permanently added %s (%s %s) to %s", hostname, key.Type(), fingerprint, file)
+		return nil
+	}
+	return callback, algorithms
+}
+
+// hostKeyTypePreference is the order the key types recorded for a host are
+// asked for in
+var hostKeyTypePreference = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA}
+
+// getKnownHostKeyAlgorithms returns the algorithms of the keys the files
+// have for the host, so the server is asked for one of those, like OpenSSH
+// does. The server would otherwise send the type x/crypto likes best, and a
+// type with no entry counts as a changed key. Nothing is returned for a host
+// the files don't know, which leaves the algorithms as they are.
+func getKnownHostKeyAlgorithms(files []string, address string) []string {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	check, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil
+	}
+
+	// A key no entry can have, to get the ones the files have
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(address, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}, probe), &keyErr) {
+		return nil
+	}
+
+	types := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		types[known.Key.Type()] = true
+	}
+	var algorithms []string
+	add := func(keyType string) {
+		if keyType == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+		delete(types, keyType)
+	}
+	for _, keyType := range hostKeyTypePreference {
+		if types[keyType] {
+			add(keyType)
+		}
+	}
+	rest := make([]string, 0, len(types))
+	for keyType := range types {
+		rest = append(rest, keyType)
+	}
+	sort.Strings(rest)
+	for _, keyType := range rest {
+		add(keyType)
+	}
+	return algorithms
+}
+
+// getKnownHostsFiles returns the known_hosts files, which knownHostsFile
+// separates with spaces like OpenSSH's UserKnownHostsFile does
+func getKnownHostsFiles(configuration Configurations) []string {
+	var files []string
+	for _, file := range strings.Fields(configuration.KnownHostsFile) {
+		files = append(files, expandHome(file))
+	}
+	if len(files) == 0 {
+		files = []string{expandHome("~/.ssh/known_hosts")}
+	}
+	return files
+}
+
+// warnHostKeyChanged tells loudly, like OpenSSH, that the host key isn't
+// the one it used to be. That may be on purpose, or someone in between.
+func warnHostKeyChanged(hostname string, key ssh.PublicKey, want []knownhosts.KnownKey, hash string) {
+	banner := strings.Repeat("@", 59)
+	lines := []string{
+		banner,
+		"@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @",
+		banner,
+		"IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!",
+		"Someone could be eavesdropping on you right now (man-in-the-middle attack)!",
+		"It is also possible that the host key has just been changed.",
+		fmt.Sprintf("The %s key sent by %s has the fingerprint %s.", key.Type(), hostname, getFingerprint(key, hash)),
+	}
+	for _, known := range want {
+		lines = append(lines, fmt.Sprintf("It doesn't match the %s key %s in %s:%d.", known.Key.Type(), getFingerprint(known.Key, hash), known.Filename, known.Line))
+	}
+	lines = append(lines,
+		"If the key was changed on purpose, remove the old one with:",
+		fmt.Sprintf("  ssh-keygen -f \"%s\" -R \"%s\"", want[0].Filename, knownhosts.Normalize(hostname)),
+	)
+	fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+}
+
+// acceptChangedHostKey tells whether the changed key of the host is to be
+// trusted from now on: with acceptChangedHostKey, or when confirmed on the
+// terminal. strictHostKeyChecking yes doesn't ask.
+func acceptChangedHostKey(configuration Configurations, hostname string) bool {
+	if configuration.AcceptChangedHostKey {
+		log.Printf("acceptChangedHostKey is set, trusting the new host key of %s. Remove the setting once the server is rebuilt.", hostname)
+		return true
+	}
+	if configuration.StrictHostKeyChecking == "yes" || !isTerminal() {
+		return false
+	}
+
+	answer, _ := readTerminalLine("Only continue if you know the host key was changed on purpose.\nReplace the known host key and continue connecting (yes/no)? ", true)
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
+
+// replaceKnownHost removes the host from the entries of its known key of
+// the type of key, like ssh-keygen -R keeping the old file as .old, and adds
+// key to that file. Keys of other types stay. So do the other hosts of an
+// entry, only this host's name is taken out of it. It returns the file key
+// was added to.
+func replaceKnownHost(want []knownhosts.KnownKey, hostname string, key ssh.PublicKey) (string, error) {
+	file := want[0].Filename
+	var lines []int
+	for _, known := range want {
+		if known.Key.Type() == key.Type() {
+			file = known.Filename
+			lines = append(lines, known.Line)
+		}
+	}
+	if len(lines) == 0 {
+		return file, addKnownHost(file, hostname, key)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("could not read knownHostsFile %s: %w", file, err)
+	}
+	updated := strings.SplitAfter(string(content), "\n")
+	for _, line := range lines {
+		if line < 1 || line > len(updated) {
+			return "", fmt.Errorf("line %d of %s is gone, not replacing the host key", line, file)
+		}
+		replaced, err := removeKnownHostName(updated[line-1], hostname)
+		if err != nil {
+			return "", fmt.Errorf("could not remove the old host key from %s:%d: %w", file, line, err)
+		}
+		updated[line-1] = replaced
+	}
+
+	if err := ioutil.WriteFile(file+".old", content, 0600); err != nil {
+		return "", fmt.Errorf("could not keep the old knownHostsFile %s: %w", file, err)
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(updated, "")), 0600); err != nil {
+		return "", fmt.Errorf("could not remove the old host key from %s: %w", file, err)
+	}
+	return file, addKnownHost(file, hostname, key)
+}
+
+// removeKnownHostName takes the host out of the host names of a known_hosts
+// line, and returns what is left of the line, which is nothing once no name
+// is left. A hashed name only stands for one host, so its line goes whole.
+// A host matched by a wildcard pattern can't be taken out of it.
+func removeKnownHostName(line string, hostname string) (string, error) {
+	content := strings.TrimLeft(line, " \t")
+	end := strings.IndexAny(content, " \t")
+	if end < 0 {
+		return line, errors.New("the entry has no key")
+	}
+	if strings.HasPrefix(content, "|") {
+		return "", nil
+	}
+
+	name := knownhosts.Normalize(hostname)
+	var kept []string
+	found := false
+	for _, pattern := range strings.Split(content[:end], ",") {
+		if strings.EqualFold(pattern, name) {
+			found = true
+			continue
+		}
+		kept = append(kept, pattern)
+	}
+	if !found {
+		return line, fmt.Errorf("%s only matches the pattern %s, change the entry by hand", name, content[:end])
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+	return strings.Join(kept, ",") + content[end:], nil
+}
+
+func addKnownHost(file string, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("could not create the directory of knownHostsFile %s: %w", file, err)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open knownHostsFile %s: %w", file, err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("could not add the host key to %s: %w", file, err)
+	}
+	return nil
+}
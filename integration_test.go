@@ -0,0 +1,124 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The image runs OpenSSH on port 2222, letting USER_NAME in with PUBLIC_KEY
+const sshServerImage = "lscr.io/linuxserver/openssh-server:latest"
+
+// TestIntegrationOpenSSH runs the engine binary against a genuine OpenSSH
+// server in Docker, with go test -tags integration
+func TestIntegrationOpenSSH(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is needed for the integration test")
+	}
+	dir := t.TempDir()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	container := docker(t, "run", "--detach", "--rm", "--publish", "127.0.0.1::2222",
+		"--env", "USER_NAME=tester", "--env", "PUBLIC_KEY="+publicKey, sshServerImage)
+	t.Cleanup(func() { exec.Command("docker", "stop", container).Run() })
+	address := docker(t, "port", container, "2222/tcp")
+	host, port, err := net.SplitHostPort(strings.Fields(address)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLogin(t, net.JoinHostPort(host, port), signer)
+
+	engine := filepath.Join(dir, "ssh-engine")
+	if output, err := exec.Command("go", "build", "-o", engine, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building the engine: %s\n%s", err, output)
+	}
+	// The engine itself exits cleanly whatever the remote exit code, which
+	// is handed to the postCommand
+	configuration := fmt.Sprintf("host: %s\nport: %s\nuser: tester\nprivateKeyFile: %s\nstrictHostKeyChecking: \"no\"\n"+
+		"postCommand: echo \"remote exit code $SSH_ENGINE_EXIT_CODE\"\n", host, port, keyFile)
+	if err := ioutil.WriteFile(filepath.Join(dir, "engine.yml"), []byte(configuration), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(engine)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader("echo \"readyok from $USER\"\nexit 3\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("running the engine: %s\n%s", err, stderr.String())
+	}
+
+	if want := "remote exit code 3\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("got %q on stderr, want it to contain %q", stderr.String(), want)
+	}
+	if want := "readyok from tester\n"; !strings.Contains(stdout.String(), want) {
+		t.Errorf("got output %q, want it to contain %q", stdout.String(), want)
+	}
+}
+
+func docker(t *testing.T, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		t.Fatalf("docker %s: %s", args[0], err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// waitForLogin waits for the container to let the key in, the port is
+// published before sshd is up and the user set up
+func waitForLogin(t *testing.T, address string, signer ssh.Signer) {
+	t.Helper()
+	sshConfig := &ssh.ClientConfig{
+		User:            "tester",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	deadline := time.Now().Add(time.Minute)
+	for {
+		client, err := ssh.Dial("tcp", address, sshConfig)
+		if err == nil {
+			client.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the OpenSSH container didn't let the key in: %s", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
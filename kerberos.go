@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// kerberosClient implements ssh.GSSAPIClient using the tickets in the
+// ambient Kerberos credential cache.
+type kerberosClient struct {
+	client     *client.Client
+	sessionKey types.EncryptionKey
+	seqNumber  int64
+}
+
+func newKerberosClient(host string) (*kerberosClient, error) {
+	krb5conf, err := config.Load(getKerberosConfigPath())
+	if err != nil {
+		return nil, fmt.Errorf("could not load the Kerberos configuration: %w", err)
+	}
+
+	path, err := getKerberosCCachePath()
+	if err != nil {
+		return nil, err
+	}
+	ccache, err := credentials.LoadCCache(path)
+	if errors.Is(err, os.ErrNotExist) && os.Getenv("KRB5CCNAME") == "" {
+		return nil, fmt.Errorf("no Kerberos credential cache at %s, a cache in KCM or the kernel keyring can't be read, set KRB5CCNAME to a FILE: cache: %w", path, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load the Kerberos credential cache: %w", err)
+	}
+
+	cl, err := client.NewFromCCache(ccache, krb5conf, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, fmt.Errorf("could not create the Kerberos client: %w", err)
+	}
+
+	// Make sure a ticket for the host can be had now, so we can fall back to
+	// other methods instead of failing in the middle of the handshake
+	if _, _, err := cl.GetServiceTicket("host/" + host); err != nil {
+		return nil, fmt.Errorf("could not get a Kerberos ticket for %s: %w", host, err)
+	}
+
+	return &kerberosClient{client: cl}, nil
+}
+
+func (k *kerberosClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	// Mutual authentication is not requested, so the server has nothing
+	// for us to process after the first token
+	if token != nil {
+		return nil, false, nil
+	}
+
+	tracef("Trying GSSAPI authentication for %s", target)
+
+	// The target comes in as host@hostname
+	tkt, sessionKey, err := k.client.GetServiceTicket(strings.Replace(target, "@", "/", 1))
+	if err != nil {
+		return nil, false, fmt.Errorf("could not get a Kerberos ticket for %s: %w", target, err)
+	}
+
+	auth, err := types.NewAuthenticator(k.client.Credentials.Domain(), k.client.Credentials.CName())
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create the Kerberos authenticator: %w", err)
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  getGssapiChecksum(gssapi.ContextFlagInteg),
+	}
+
+	apReq, err := messages.NewAPReq(tkt, sessionKey, auth)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not create the Kerberos AP_REQ: %w", err)
+	}
+	apReqBytes, err := apReq.Marshal()
+	if err != nil {
+		return nil, false, fmt.Errorf("could not marshal the Kerberos AP_REQ: %w", err)
+	}
+
+	// GSS-API initial context token: mech OID, token ID and the AP_REQ
+	b, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, false, fmt.Errorf("could not marshal the Kerberos mech OID: %w", err)
+	}
+	b = append(b, 0x01, 0x00)
+	b = append(b, apReqBytes...)
+
+	k.sessionKey = sessionKey
+	k.seqNumber = auth.SeqNumber
+
+	return asn1tools.AddASNAppTag(b, 0), false, nil
+}
+
+func (k *kerberosClient) GetMIC(micField []byte) ([]byte, error) {
+	token := gssapi.MICToken{
+		SndSeqNum: uint64(k.seqNumber),
+		Payload:   micField,
+	}
+	if err := token.SetChecksum(k.sessionKey, keyusage.GSSAPI_INITIATOR_SIGN); err != nil {
+		return nil, fmt.Errorf("could not compute the Kerberos MIC: %w", err)
+	}
+
+	return token.Marshal()
+}
+
+func (k *kerberosClient) DeleteSecContext() error {
+	k.client.Destroy()
+	return nil
+}
+
+// getGssapiChecksum builds the authenticator checksum of RFC 4121 4.1.1,
+// without channel bindings.
+func getGssapiChecksum(flags ...int) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:4], 16)
+	var f uint32
+	for _, flag := range flags {
+		f |= uint32(flag)
+	}
+	binary.LittleEndian.PutUint32(b[20:24], f)
+
+	return b
+}
+
+func getKerberosConfigPath() string {
+	if path := os.Getenv("KRB5_CONFIG"); path != "" {
+		return path
+	}
+	return "/etc/krb5.conf"
+}
+
+// getKerberosCCachePath returns the file of the credential cache. Only
+// FILE: caches can be read, not the KCM or KEYRING: ones many distributions
+// default to.
+func getKerberosCCachePath() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()), nil
+	}
+	if i := strings.Index(name, ":"); i > 0 && !strings.HasPrefix(name, "/") {
+		if cacheType := name[:i]; cacheType != "FILE" {
+			return "", fmt.Errorf("the Kerberos credential cache %s is of type %s, only FILE: caches are supported, get the tickets into one with kinit -c FILE:/tmp/krb5cc_%d", name, cacheType, os.Getuid())
+		}
+		return name[i+1:], nil
+	}
+	return name, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// privateKeyFormats names the PEM block types of the private keys that
+// x/crypto/ssh reads, the way ssh-keygen and openssl write them
+var privateKeyFormats = map[string]string{
+	"OPENSSH PRIVATE KEY": "OpenSSH",
+	"PRIVATE KEY":         "PKCS#8",
+	"RSA PRIVATE KEY":     "PEM RSA (PKCS#1)",
+	"EC PRIVATE KEY":      "PEM EC",
+	"DSA PRIVATE KEY":     "PEM DSA",
+}
+
+const supportedKeyFormats = "expected an OpenSSH, PKCS#8, PEM RSA, PEM EC or PuTTY private key"
+
+// parsePrivateKey parses a private key in the OpenSSH format, PKCS#8, or
+// the PEM RSA, EC and DSA formats. The passphrase is only used if the key
+// is encrypted. The errors name the format the key is in, and how to
+// convert the formats that can't be read.
+func parsePrivateKey(file string, buf []byte, passphrase string) (ssh.Signer, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(buf))
+	if block == nil {
+		return nil, getNoKeyError(file, buf)
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("encrypted PKCS#8 keys are not supported, convert it to the OpenSSH format with: ssh-keygen -p -f \"%s\"", file)
+	}
+	format, ok := privateKeyFormats[block.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PEM block %q, %s", block.Type, supportedKeyFormats)
+	}
+
+	key, err := ssh.ParsePrivateKey(buf)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("the %s key is encrypted, set privateKeyPassphrase", format)
+		}
+		key, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("wrong privateKeyPassphrase for the %s key: %w", format, err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the %s key: %w", format, err)
+	}
+	return key, nil
+}
+
+// getNoKeyError explains what a file that isn't a PEM private key is, as
+// people put all sorts of keys in privateKeyFile
+func getNoKeyError(file string, buf []byte) error {
+	trimmed := bytes.TrimSpace(buf)
+	_, _, _, _, err := ssh.ParseAuthorizedKey(trimmed)
+	if err == nil || bytes.HasPrefix(trimmed, []byte("---- BEGIN SSH2 PUBLIC KEY")) {
+		return errors.New("this is a public key, privateKeyFile needs the private key that goes with it")
+	}
+	if bytes.HasPrefix(trimmed, []byte("---- BEGIN SSH2")) {
+		return fmt.Errorf("SSH2 (RFC 4716) keys are not supported, convert it to the OpenSSH format with: ssh-keygen -i -f \"%s\"", file)
+	}
+	return errors.New("no private key found, " + supportedKeyFormats)
+}
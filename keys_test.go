@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGetKeyFile(t *testing.T) {
+	// ed25519 keys have no PEM format of their own, ssh-keygen writes the
+	// OpenSSH one for them
+	keys := []struct {
+		file      string
+		keyType   string
+		format    string
+		encrypted bool
+	}{
+		{"rsa-openssh", "ssh-rsa", "OpenSSH", false},
+		{"rsa-openssh-encrypted", "ssh-rsa", "OpenSSH", true},
+		{"rsa-pem", "ssh-rsa", "PEM RSA (PKCS#1)", false},
+		{"rsa-pem-encrypted", "ssh-rsa", "PEM RSA (PKCS#1)", true},
+		{"rsa-pkcs8", "ssh-rsa", "PKCS#8", false},
+		{"ecdsa-openssh", "ecdsa-sha2-nistp256", "OpenSSH", false},
+		{"ecdsa-openssh-encrypted", "ecdsa-sha2-nistp256", "OpenSSH", true},
+		{"ecdsa-pem", "ecdsa-sha2-nistp256", "PEM EC", false},
+		{"ecdsa-pem-encrypted", "ecdsa-sha2-nistp256", "PEM EC", true},
+		{"ecdsa-pkcs8", "ecdsa-sha2-nistp256", "PKCS#8", false},
+		{"ed25519-openssh", "ssh-ed25519", "OpenSSH", false},
+		{"ed25519-openssh-encrypted", "ssh-ed25519", "OpenSSH", true},
+		{"ed25519-pkcs8", "ssh-ed25519", "PKCS#8", false},
+	}
+
+	for _, key := range keys {
+		file := filepath.Join("testdata", "keys", key.file)
+		t.Run(key.file, func(t *testing.T) {
+			// A passphrase given for an unencrypted key is left alone
+			for _, passphrase := range []string{"", "pw"} {
+				signer, err := getKeyFile(file, passphrase)
+				if key.encrypted && passphrase == "" {
+					want := "the " + key.format + " key is encrypted, set privateKeyPassphrase"
+					if err == nil || !strings.Contains(err.Error(), want) {
+						t.Errorf("without a passphrase got %v, want %q", err, want)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("passphrase %q: %s", passphrase, err)
+				}
+				if got := signer.PublicKey().Type(); got != key.keyType {
+					t.Errorf("got a %s key, want %s", got, key.keyType)
+				}
+			}
+
+			if key.encrypted {
+				_, err := getKeyFile(file, "wrong")
+				if want := "wrong privateKeyPassphrase for the " + key.format + " key"; err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("with a wrong passphrase got %v, want %q", err, want)
+				}
+				if !errors.Is(err, x509.IncorrectPasswordError) {
+					t.Errorf("error %v doesn't wrap %v", err, x509.IncorrectPasswordError)
+				}
+			}
+		})
+	}
+}
+
+func TestGetKeyFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		buf     string
+		wantMsg string
+	}{
+		{
+			name:    "encrypted PKCS#8",
+			file:    filepath.Join("testdata", "keys", "rsa-pkcs8-encrypted"),
+			wantMsg: "encrypted PKCS#8 keys are not supported, convert it to the OpenSSH format with: ssh-keygen -p -f",
+		},
+		{
+			name:    "OpenSSH public key",
+			file:    filepath.Join("testdata", "keys", "ed25519-openssh.pub"),
+			wantMsg: "this is a public key, privateKeyFile needs the private key that goes with it",
+		},
+		{
+			name:    "SSH2 public key",
+			file:    filepath.Join("testdata", "keys", "rsa-ssh2.pub"),
+			wantMsg: "this is a public key, privateKeyFile needs the private key that goes with it",
+		},
+		{
+			name:    "SSH2 private key",
+			buf:     "---- BEGIN SSH2 ENCRYPTED PRIVATE KEY ----\nP2/56wAAAi4AAAA3\n---- END SSH2 ENCRYPTED PRIVATE KEY ----\n",
+			wantMsg: "SSH2 (RFC 4716) keys are not supported, convert it to the OpenSSH format with: ssh-keygen -i -f",
+		},
+		{
+			name:    "unknown PEM block",
+			buf:     "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+			wantMsg: `unsupported PEM block "CERTIFICATE", ` + supportedKeyFormats,
+		},
+		{
+			name:    "no key",
+			buf:     "not a key\n",
+			wantMsg: "no private key found, " + supportedKeyFormats,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := test.file
+			if file == "" {
+				file = writeKeyFile(t, []byte(test.buf))
+			}
+			_, err := getKeyFile(file, "pw")
+			if err == nil || !strings.Contains(err.Error(), test.wantMsg) {
+				t.Errorf("got %v, want %q", err, test.wantMsg)
+			}
+		})
+	}
+}
+
+func TestGetPuttyKeyFile(t *testing.T) {
+	// The PuTTY keys hold the same keys as the OpenSSH ones
+	keys := []struct {
+		file      string
+		openssh   string
+		encrypted bool
+	}{
+		{"rsa-ppk2", "rsa-openssh", false},
+		{"rsa-ppk2-encrypted", "rsa-openssh", true},
+		{"rsa-ppk3", "rsa-openssh", false},
+		{"ecdsa-ppk2", "ecdsa-openssh", false},
+		{"ecdsa-ppk3", "ecdsa-openssh", false},
+		{"ecdsa-ppk3-encrypted", "ecdsa-openssh", true},
+		{"ed25519-ppk2", "ed25519-openssh", false},
+		{"ed25519-ppk2-encrypted", "ed25519-openssh", true},
+		{"ed25519-ppk3", "ed25519-openssh", false},
+		{"ed25519-ppk3-encrypted", "ed25519-openssh", true},
+	}
+
+	for _, key := range keys {
+		file := filepath.Join("testdata", "keys", key.file)
+		t.Run(key.file, func(t *testing.T) {
+			want, err := getKeyFile(filepath.Join("testdata", "keys", key.openssh), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, passphrase := range []string{"", "pw"} {
+				signer, err := getKeyFile(file, passphrase)
+				if key.encrypted && passphrase == "" {
+					if want := "the PuTTY key is encrypted, but no privateKeyPassphrase is configured"; err == nil || !strings.Contains(err.Error(), want) {
+						t.Errorf("without a passphrase got %v, want %q", err, want)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("passphrase %q: %s", passphrase, err)
+				}
+				if !bytes.Equal(signer.PublicKey().Marshal(), want.PublicKey().Marshal()) {
+					t.Errorf("got %s, want the key of %s", ssh.FingerprintSHA256(signer.PublicKey()), key.openssh)
+				}
+			}
+
+			if key.encrypted {
+				_, err := getKeyFile(file, "wrong")
+				if want := "wrong passphrase for the PuTTY key (MAC mismatch)"; err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("with a wrong passphrase got %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPuttyKeyFileErrors(t *testing.T) {
+	readKey := func(name string) string {
+		buf, err := ioutil.ReadFile(filepath.Join("testdata", "keys", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	plain := readKey("ed25519-ppk3")
+	encrypted := readKey("rsa-ppk2-encrypted")
+
+	tests := []struct {
+		name    string
+		buf     string
+		wantMsg string
+	}{
+		{
+			name:    "changed comment",
+			buf:     strings.Replace(plain, "Comment: ", "Comment: changed ", 1),
+			wantMsg: "the PuTTY key is corrupted (MAC mismatch)",
+		},
+		{
+			name:    "changed MAC",
+			buf:     strings.Replace(plain, "Private-MAC: ", "Private-MAC: 00", 1),
+			wantMsg: "the PuTTY key is corrupted (MAC mismatch)",
+		},
+		{
+			name:    "missing MAC",
+			buf:     plain[:strings.Index(plain, "Private-MAC: ")],
+			wantMsg: "missing or invalid Private-MAC in the PuTTY key",
+		},
+		{
+			name:    "format 1",
+			buf:     strings.Replace(plain, "PuTTY-User-Key-File-3", "PuTTY-User-Key-File-1", 1),
+			wantMsg: `unsupported PuTTY key format "PuTTY-User-Key-File-1", only versions 2 and 3 are supported`,
+		},
+		{
+			name:    "unknown encryption",
+			buf:     strings.Replace(encrypted, "Encryption: aes256-cbc", "Encryption: aes128-cbc", 1),
+			wantMsg: `unsupported PuTTY key encryption "aes128-cbc"`,
+		},
+		{
+			name:    "too few lines",
+			buf:     strings.Replace(plain, "Private-Lines: 1", "Private-Lines: 9", 1),
+			wantMsg: "invalid Private-Lines in the PuTTY key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := getKeyFile(writeKeyFile(t, []byte(test.buf)), "pw")
+			if err == nil || !strings.Contains(err.Error(), test.wantMsg) {
+				t.Errorf("got %v, want %q", err, test.wantMsg)
+			}
+		})
+	}
+}
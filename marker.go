@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// commandMarker lets the commands sent to the shell wait for each other.
+// Every command is sent with an echo of the marker and its exit status
+// after it, and the next one waits until the marker shows up on a line of
+// its own in the output. The marker is echoed to stderr as well, to tell
+// which command wrote what there. The marker lines are taken out of the
+// output. On the way, the result of each command is recorded, with its
+// output when captureOutput is set.
+type commandMarker struct {
+	text    string
+	mu      sync.Mutex
+	stdout  markerStream
+	pending bool
+	seen    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	current commandResult
+	results []commandResult
+	// skipped is set when the when clause of the last command didn't hold
+	skipped bool
+	// stderrIndex is the command the output on stderr is from, those before
+	// it have echoed their marker there
+	stderrIndex int
+	// captureOutput records the output of the commands in their results
+	captureOutput bool
+}
+
+// commandResult is how a command did: its exit status, how long it took
+// from sending it until its marker showed up, and the output it wrote on
+// the way
+type commandResult struct {
+	command    string
+	started    time.Time
+	duration   time.Duration
+	exitStatus int
+	stdout     []byte
+	stderr     []byte
+}
+
+func newCommandMarker(w io.Writer, text string) *commandMarker {
+	m := &commandMarker{
+		text:   text,
+		seen:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	m.stdout = markerStream{marker: m, w: w, marked: m.finish, output: m.captureStdout}
+	return m
+}
+
+// suffix is what is sent after the command
+func (m *commandMarker) suffix() string {
+	return "; echo " + m.text + " $?; echo " + m.text + " >&2"
+}
+
+// wait blocks until the command sent before is done, or the session is.
+// It returns the result of that command, if it was sent and finished.
+func (m *commandMarker) wait() (commandResult, bool) {
+	if m.pending {
+		select {
+		case <-m.seen:
+		case <-m.closed:
+		}
+	}
+	m.pending = false
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.skipped || !m.current.started.IsZero() || len(m.results) == 0 {
+		return commandResult{}, false
+	}
+	return m.results[len(m.results)-1], true
+}
+
+// start times the command about to be sent, the next one waits for it
+func (m *commandMarker) start(command string) {
+	m.pending = true
+
+	m.mu.Lock()
+	m.current = commandResult{command: command, started: time.Now()}
+	m.skipped = false
+	m.mu.Unlock()
+}
+
+// skip notes that the command isn't sent, as its when clause doesn't hold.
+// It is left out of the results.
+func (m *commandMarker) skip(command string, condition *commandCondition) {
+	log.Printf("Skipping %q, %s doesn't hold", command, condition.text)
+
+	m.mu.Lock()
+	m.skipped = true
+	m.mu.Unlock()
+}
+
+// close stops any wait, once the session is over
+func (m *commandMarker) close() {
+	m.once.Do(func() { close(m.closed) })
+}
+
+func (m *commandMarker) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stdout.write(p)
+}
+
+// stderr returns a writer that takes the marker lines out of stderr before
+// passing it on to w
+func (m *commandMarker) stderr(w io.Writer) io.Writer {
+	return &markerStderr{markerStream{marker: m, w: w, marked: m.finishStderr, output: m.captureStderr}}
+}
+
+type markerStderr struct {
+	stream markerStream
+}
+
+func (s *markerStderr) Write(p []byte) (int, error) {
+	s.stream.marker.mu.Lock()
+	defer s.stream.marker.mu.Unlock()
+
+	return s.stream.write(p)
+}
+
+// finish records the result of the command whose marker showed up on
+// stdout, and lets the next one be sent
+func (m *commandMarker) finish(status int) {
+	if !m.current.started.IsZero() {
+		m.current.duration = time.Since(m.current.started)
+		m.current.exitStatus = status
+		m.results = append(m.results, m.current)
+		if debugLogging {
+			log.Printf("Command %q exited with %d after %s", m.current.command, status, m.current.duration)
+		}
+		m.current = commandResult{}
+	}
+	m.checkDone()
+}
+
+// finishStderr moves the output on stderr on to the next command
+func (m *commandMarker) finishStderr(int) {
+	m.stderrIndex++
+	m.checkDone()
+}
+
+// checkDone lets the next command be sent once the marker of the one
+// before showed up on both stdout and stderr, so all of its output is in
+func (m *commandMarker) checkDone() {
+	if !m.current.started.IsZero() || m.stderrIndex < len(m.results) {
+		return
+	}
+	select {
+	case m.seen <- struct{}{}:
+	default:
+	}
+}
+
+func (m *commandMarker) captureStdout(p []byte) {
+	if m.captureOutput && !m.current.started.IsZero() {
+		m.current.stdout = append(m.current.stdout, p...)
+	}
+}
+
+func (m *commandMarker) captureStderr(p []byte) {
+	if !m.captureOutput {
+		return
+	}
+	if m.stderrIndex < len(m.results) {
+		m.results[m.stderrIndex].stderr = append(m.results[m.stderrIndex].stderr, p...)
+	} else if m.stderrIndex == len(m.results) && !m.current.started.IsZero() {
+		m.current.stderr = append(m.current.stderr, p...)
+	}
+}
+
+// getMarkerStatus tells whether the line is the marker, and the exit status
+// that came with it. A status that can't be read is -1.
+func (m *commandMarker) getMarkerStatus(line string) (int, bool) {
+	if line == m.text {
+		return -1, true
+	}
+	if !strings.HasPrefix(line, m.text+" ") {
+		return 0, false
+	}
+	status, err := strconv.Atoi(strings.TrimPrefix(line, m.text+" "))
+	if err != nil {
+		return -1, true
+	}
+	return status, true
+}
+
+// mayBeMarker tells whether the start of a line may be the start of a
+// marker line
+func (m *commandMarker) mayBeMarker(start string) bool {
+	if strings.HasPrefix(m.text, start) {
+		return true
+	}
+	status := strings.TrimPrefix(start, m.text+" ")
+	return len(status) < len(start) && strings.Trim(status, "-0123456789") == ""
+}
+
+// markerStream takes the marker lines out of one stream of output, passing
+// the rest on to w. The marker is held by the caller.
+type markerStream struct {
+	marker  *commandMarker
+	w       io.Writer
+	buf     []byte
+	partial bool
+	// marked is called for a marker line, output for everything else
+	marked func(status int)
+	output func(p []byte)
+}
+
+func (s *markerStream) write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := s.buf[:i+1]
+		status, isMarker := s.marker.getMarkerStatus(strings.TrimRight(string(line), "\r\n"))
+		if !s.partial && isMarker {
+			s.marked(status)
+		} else {
+			if _, err := s.w.Write(line); err != nil {
+				return 0, err
+			}
+			s.output(line)
+		}
+		s.partial = false
+		s.buf = s.buf[i+1:]
+	}
+
+	// The start of a line is held back as long as it may be the marker,
+	// anything else, like a prompt, is written right away
+	if len(s.buf) > 0 && (s.partial || !s.marker.mayBeMarker(string(s.buf))) {
+		if _, err := s.w.Write(s.buf); err != nil {
+			return 0, err
+		}
+		s.output(s.buf)
+		s.partial = true
+		s.buf = nil
+	}
+
+	return len(p), nil
+}
+
+// printTimings writes a table of the commands that finished, how long they
+// took and their exit status, with the total at the end
+func (m *commandMarker) printTimings(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "DURATION\tSTATUS\tCOMMAND")
+	var total time.Duration
+	for _, result := range m.results {
+		fmt.Fprintf(t, "%s\t%d\t%s\n", result.duration.Round(time.Millisecond), result.exitStatus, result.command)
+		total += result.duration
+	}
+	fmt.Fprintf(t, "%s\t\t(total of %d commands)\n", total.Round(time.Millisecond), len(m.results))
+	t.Flush()
+}
+
+// writeResults writes the results of the commands that finished to the
+// file, as a JSON array with an object for every command
+func (m *commandMarker) writeResults(file string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type result struct {
+		Command    string `json:"command"`
+		ExitStatus int    `json:"exitStatus"`
+		DurationMs int64  `json:"durationMs"`
+		Stdout     string `json:"stdout"`
+		Stderr     string `json:"stderr"`
+	}
+	results := make([]result, len(m.results))
+	for i, r := range m.results {
+		results[i] = result{
+			Command:    r.command,
+			ExitStatus: r.exitStatus,
+			DurationMs: r.duration.Milliseconds(),
+			Stdout:     string(r.stdout),
+			Stderr:     string(r.stderr),
+		}
+	}
+
+	buf, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(buf, '\n'), 0644)
+}
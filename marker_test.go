@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandMarker(t *testing.T) {
+	var out, errOut bytes.Buffer
+	m := newCommandMarker(&out, "__done__")
+	m.captureOutput = true
+	stderr := m.stderr(&errOut)
+
+	m.wait()
+	m.start("first")
+	m.Write([]byte("one\n__do"))
+	m.Write([]byte("ne__ 0\n"))
+	// The output on stderr may come after the marker on stdout
+	stderr.Write([]byte("warning\n__done__\n"))
+	m.wait()
+	m.start("second")
+	m.Write([]byte("__done__x\ntwo\n__done__ 2"))
+	m.Write([]byte("\n"))
+	stderr.Write([]byte("error\n__done__\n"))
+	m.wait()
+	m.start("third")
+	m.Write([]byte("__done__\n"))
+	stderr.Write([]byte("__done__\n"))
+	if prev, finished := m.wait(); !finished || prev.command != "third" {
+		t.Errorf("got %q, %v for the command before, want the third one", prev.command, finished)
+	}
+
+	if want := "one\n__done__x\ntwo\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+	if want := "warning\nerror\n"; errOut.String() != want {
+		t.Errorf("got error output %q, want %q", errOut.String(), want)
+	}
+
+	want := []struct {
+		command    string
+		exitStatus int
+		stdout     string
+		stderr     string
+	}{
+		{"first", 0, "one\n", "warning\n"},
+		{"second", 2, "__done__x\ntwo\n", "error\n"},
+		{"third", -1, "", ""},
+	}
+	if len(m.results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(m.results), len(want))
+	}
+	for i, w := range want {
+		r := m.results[i]
+		if r.command != w.command || r.exitStatus != w.exitStatus || string(r.stdout) != w.stdout || string(r.stderr) != w.stderr {
+			t.Errorf("result %d: got %q exited %d with %q and %q, want %q exited %d with %q and %q", i,
+				r.command, r.exitStatus, r.stdout, r.stderr, w.command, w.exitStatus, w.stdout, w.stderr)
+		}
+	}
+}
+
+// TestCommandMarkerWithShell sends the commands to a local shell, the way
+// they are sent to the remote one, and reads back the results it wrote
+func TestCommandMarkerWithShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell to run the commands")
+	}
+
+	var out bytes.Buffer
+	m := newCommandMarker(&out, "__done__")
+	m.captureOutput = true
+	cmd := exec.Command("sh")
+	cmd.Stdout = m
+	cmd.Stderr = m.stderr(ioutil.Discard)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := newCommandSender(stdin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.marker = m
+	for _, command := range []string{"echo hello", "echo oops >&2; false", "exit 3"} {
+		if err := sender.send(command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdin.Close()
+	cmd.Wait()
+	m.close()
+
+	file := filepath.Join(t.TempDir(), "results.json")
+	if err := m.writeResults(file); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []struct {
+		Command    string `json:"command"`
+		ExitStatus int    `json:"exitStatus"`
+		Stdout     string `json:"stdout"`
+		Stderr     string `json:"stderr"`
+	}
+	if err := json.Unmarshal(buf, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell exits before the marker of the last command
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %s", len(results), buf)
+	}
+	if r := results[0]; r.Command != "echo hello" || r.ExitStatus != 0 || r.Stdout != "hello\n" || r.Stderr != "" {
+		t.Errorf("got %+v for the first command", r)
+	}
+	if r := results[1]; r.Command != "echo oops >&2; false" || r.ExitStatus != 1 || r.Stdout != "" || r.Stderr != "oops\n" {
+		t.Errorf("got %+v for the second command", r)
+	}
+}
+
+// TestCommandMarkerWhen sends the commands of a command file with when
+// clauses to a local shell
+func TestCommandMarkerWhen(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell to run the commands")
+	}
+
+	var out bytes.Buffer
+	m := newCommandMarker(&out, "__done__")
+	m.captureOutput = true
+	cmd := exec.Command("sh")
+	cmd.Stdout = m
+	cmd.Stderr = m.stderr(ioutil.Discard)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := newCommandSender(stdin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.marker = m
+	sender.conditional = true
+	for _, line := range []string{
+		"echo active",
+		"when prev.stdout matches '^active': echo reloaded",
+		"when prev.exit != 0: echo not sent",
+		"when prev.exit == 0: echo not sent either, the one before was skipped",
+		"echo failed >&2; false",
+		"when prev.stderr matches 'failed': echo retried",
+	} {
+		if err := sender.send(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdin.Close()
+	cmd.Wait()
+	m.close()
+
+	if want := "active\nreloaded\nretried\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// chooseProfile shows the profiles of engine.yml as a numbered menu on the
+// terminal and returns the one picked, by number, name or the start of a
+// name. Nothing picks the base settings, returned as "".
+func chooseProfile() (string, error) {
+	profiles, _ := viper.Get("profiles").(map[string]interface{})
+	if len(profiles) == 0 {
+		return "", nil
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Profiles of engine.yml:")
+	fmt.Fprintf(os.Stderr, "  0) none, the base settings (%s)\n", viper.GetString("host"))
+	for i, name := range names {
+		host := viper.GetString("profiles." + name + ".host")
+		if host == "" {
+			host = viper.GetString("host")
+		}
+		fmt.Fprintf(os.Stderr, "  %d) %s (%s)\n", i+1, name, host)
+	}
+
+	for {
+		answer, err := readTerminalLine("Profile to use [0]: ", true)
+		answer = strings.TrimSpace(answer)
+		if err != nil && answer == "" {
+			return "", errors.New("no profile chosen")
+		}
+		if answer == "" || answer == "0" {
+			return "", nil
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(names) {
+			return names[n-1], nil
+		}
+		if name, ok := matchProfile(names, answer); ok {
+			return name, nil
+		}
+		fmt.Fprintf(os.Stderr, "No single profile matches '%s', enter 0 to %d or a name\n", answer, len(names))
+	}
+}
+
+// matchProfile finds the profile named answer, or the only one starting
+// with it, ignoring case
+func matchProfile(names []string, answer string) (string, bool) {
+	answer = strings.ToLower(answer)
+	var matches []string
+	for _, name := range names {
+		if strings.ToLower(name) == answer {
+			return name, true
+		}
+		if strings.HasPrefix(strings.ToLower(name), answer) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// applySshOptions sets the OpenSSH style options on the client
+// configuration. viper lower cases the option names, which is fine since
+// OpenSSH treats them case insensitively too.
+func applySshOptions(sshConfig *ssh.ClientConfig, options map[string]string) error {
+	// Sorted so warnings and errors come out in a stable order
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := options[name]
+		switch strings.ToLower(name) {
+		case "connecttimeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("invalid ConnectTimeout %q, expected a number of seconds", value)
+			}
+			sshConfig.Timeout = time.Duration(seconds) * time.Second
+		case "ciphers":
+			sshConfig.Ciphers = splitSshOptionList(value)
+		case "macs":
+			sshConfig.MACs = splitSshOptionList(value)
+		case "kexalgorithms":
+			sshConfig.KeyExchanges = splitSshOptionList(value)
+		case "hostkeyalgorithms":
+			sshConfig.HostKeyAlgorithms = splitSshOptionList(value)
+		case "identitiesonly":
+			// Picked up when the authentication methods are chosen
+			if v := strings.ToLower(value); v != "yes" && v != "no" {
+				return fmt.Errorf("invalid IdentitiesOnly %q, expected yes or no", value)
+			}
+		case "stricthostkeychecking":
+			// Picked up as strictHostKeyChecking when engine.yml is read
+		default:
+			log.Printf("Ignoring unknown SSH option %s", name)
+		}
+	}
+
+	return nil
+}
+
+func splitSshOptionList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// sshOptionNames spells the supported options the way ssh_config does
+var sshOptionNames = map[string]string{
+	"connecttimeout":        "ConnectTimeout",
+	"ciphers":               "Ciphers",
+	"macs":                  "MACs",
+	"kexalgorithms":         "KexAlgorithms",
+	"hostkeyalgorithms":     "HostKeyAlgorithms",
+	"identitiesonly":        "IdentitiesOnly",
+	"stricthostkeychecking": "StrictHostKeyChecking",
+}
+
+// writeSshConfigHost writes a Host block for ~/.ssh/config that connects
+// the way the configuration does, as far as OpenSSH has settings for it.
+// The settings it has none for are noted in comments.
+func writeSshConfigHost(w io.Writer, alias string, configuration Configurations) error {
+	lines := []string{"Host " + alias}
+	add := func(name string, value string) {
+		if value != "" {
+			lines = append(lines, "    "+name+" "+value)
+		}
+	}
+
+	add("HostName", configuration.Host)
+	add("User", configuration.User)
+	add("Port", configuration.Port)
+	add("IdentityFile", configuration.PrivateKeyFile)
+	if configuration.IdentitiesOnly {
+		add("IdentitiesOnly", "yes")
+	}
+	if configuration.Kerberos {
+		add("GSSAPIAuthentication", "yes")
+	}
+	for _, spec := range configuration.LocalForwards {
+		listen, target, err := parseForward(spec)
+		if err != nil {
+			return err
+		}
+		add("LocalForward", listen+" "+target)
+	}
+	for _, spec := range configuration.RemoteForwards {
+		listen, target, err := parseForward(spec)
+		if err != nil {
+			return err
+		}
+		add("RemoteForward", listen+" "+target)
+	}
+	if configuration.ServerAliveInterval > 0 {
+		add("ServerAliveInterval", strconv.Itoa(configuration.ServerAliveInterval))
+		add("ServerAliveCountMax", strconv.Itoa(configuration.ServerAliveCountMax))
+	}
+	if configuration.TcpKeepAlive < 0 {
+		add("TCPKeepAlive", "no")
+	}
+	if configuration.RekeyThreshold > 0 {
+		add("RekeyLimit", strconv.FormatUint(configuration.RekeyThreshold, 10))
+	}
+	add("RemoteCommand", configuration.RemoteCommand)
+
+	names := make([]string, 0, len(configuration.Options))
+	for name := range configuration.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if option, ok := sshOptionNames[strings.ToLower(name)]; ok && !(option == "IdentitiesOnly" && configuration.IdentitiesOnly) {
+			add(option, configuration.Options[name])
+		}
+	}
+
+	if configuration.WebsocketURL != "" {
+		lines = append(lines, "    # websocketURL has no ssh_config setting, use a ProxyCommand that tunnels to "+configuration.WebsocketURL)
+	}
+	if len(configuration.FallbackHosts) > 0 {
+		lines = append(lines, "    # fallbackHosts has no ssh_config setting: "+strings.Join(configuration.FallbackHosts, ", "))
+	}
+	if configuration.HostKeyVerifierCommand != "" {
+		lines = append(lines, "    # hostKeyVerifierCommand has no ssh_config setting, use KnownHostsCommand on OpenSSH 8.5 or later")
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLineLength bounds how much of a line without a newline is kept
+// around for the callback.
+const maxLineLength = 64 * 1024
+
+// maxExpectedOutput is how much of the end of the output expectOutput is
+// matched against
+const maxExpectedOutput = 1024 * 1024
+
+// lineWriter passes everything written to it straight on to w, and calls
+// onLine with every complete line on the way, without its line ending.
+type lineWriter struct {
+	w      io.Writer
+	onLine func(line string)
+	buf    []byte
+}
+
+func newLineWriter(w io.Writer, onLine func(line string)) *lineWriter {
+	return &lineWriter{w: w, onLine: onLine}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+
+	l.buf = append(l.buf, p[:n]...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.onLine(strings.TrimSuffix(string(l.buf[:i]), "\r"))
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) > maxLineLength {
+		l.onLine(string(l.buf))
+		l.buf = nil
+	}
+
+	return n, err
+}
+
+// Flush calls onLine with what is left of a last line without a newline
+func (l *lineWriter) Flush() {
+	if len(l.buf) > 0 {
+		l.onLine(string(l.buf))
+		l.buf = nil
+	}
+}
+
+// outputWatcher is shown the output on its way, to react to what shows up
+// in it. Watching has no say in whether the output gets through, so a
+// watcher deals with its own errors.
+type outputWatcher interface {
+	watch(p []byte)
+}
+
+// watchWriter passes everything written to it on to w, and shows it to the
+// watcher as well
+type watchWriter struct {
+	w       io.Writer
+	watcher outputWatcher
+}
+
+func newWatchWriter(w io.Writer, watcher outputWatcher) *watchWriter {
+	return &watchWriter{w: w, watcher: watcher}
+}
+
+func (w *watchWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.watcher.watch(p)
+	return n, err
+}
+
+// commandEcho writes the commands sent into the output, as "+ command"
+// lines like set -x does. The session writes its output to it as well, on
+// its own goroutine, so the two take turns.
+type commandEcho struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newCommandEcho(w io.Writer) *commandEcho {
+	return &commandEcho{w: w}
+}
+
+func (e *commandEcho) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.w.Write(p)
+}
+
+func (e *commandEcho) echo(command string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err := fmt.Fprintf(e.w, "+ %s\n", command)
+	return err
+}
+
+// tailBuffer keeps the last max bytes written to it. Stdout and stderr are
+// copied on their own goroutines, so it may be written to concurrently.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.buf
+}
+
+// lineBuffer holds output back until a line is complete, so a line is
+// always written in one go. Lines longer than maxLineLength are written in
+// parts, and Flush writes what is left of the last line. A fatal exit may
+// flush it while the session still writes to it.
+type lineBuffer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newLineBuffer(w io.Writer) *lineBuffer {
+	return &lineBuffer{w: w}
+}
+
+func (l *lineBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	end := bytes.LastIndexByte(l.buf, '\n') + 1
+	if end == 0 && len(l.buf) > maxLineLength {
+		end = len(l.buf)
+	}
+	if end > 0 {
+		if _, err := l.w.Write(l.buf[:end]); err != nil {
+			return 0, err
+		}
+		l.buf = append(l.buf[:0], l.buf[end:]...)
+	}
+
+	return len(p), nil
+}
+
+func (l *lineBuffer) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) == 0 {
+		return nil
+	}
+	_, err := l.w.Write(l.buf)
+	l.buf = nil
+	return err
+}
+
+// timestampWriter prefixes every line with the local time it started, in
+// the layout of the time package. A line written in parts gets the time of
+// its first part.
+type timestampWriter struct {
+	w      io.Writer
+	layout string
+	inLine bool
+}
+
+func newTimestampWriter(w io.Writer, layout string) *timestampWriter {
+	return &timestampWriter{w: w, layout: layout}
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if !t.inLine {
+			if _, err := io.WriteString(t.w, time.Now().Format(t.layout)+" "); err != nil {
+				return 0, err
+			}
+			t.inLine = true
+		}
+		end := bytes.IndexByte(p, '\n') + 1
+		if end == 0 {
+			end = len(p)
+		} else {
+			t.inLine = false
+		}
+		if _, err := t.w.Write(p[:end]); err != nil {
+			return 0, err
+		}
+		p = p[end:]
+	}
+
+	return n, nil
+}
+
+// outputLimit caps the output of stdout and stderr together at max bytes.
+// What comes after is read and dropped, so the remote is never held up,
+// and a marker tells the output was cut.
+type outputLimit struct {
+	mu        sync.Mutex
+	max       int64
+	written   int64
+	truncated bool
+}
+
+func newOutputLimit(max int64) *outputLimit {
+	return &outputLimit{max: max}
+}
+
+// writer returns the writer of one of the streams, counting against the
+// limit shared by both
+func (o *outputLimit) writer(w io.Writer) io.Writer {
+	return &limitedWriter{limit: o, w: w}
+}
+
+type limitedWriter struct {
+	limit *outputLimit
+	w     io.Writer
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	o := l.limit
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.truncated {
+		return len(p), nil
+	}
+	if left := o.max - o.written; int64(len(p)) > left {
+		if _, err := l.w.Write(p[:left]); err != nil {
+			return 0, err
+		}
+		o.written = o.max
+		o.truncated = true
+		fmt.Fprintf(l.w, "\n[ssh-engine: output truncated after %d bytes]\n", o.max)
+		return len(p), nil
+	}
+
+	if _, err := l.w.Write(p); err != nil {
+		return 0, err
+	}
+	o.written += int64(len(p))
+	return len(p), nil
+}
+
+// logLimit caps how much of the output goes to the log, for stdout and
+// stderr together, at max bytes. A max of 0 logs everything. What doesn't
+// fit is counted, and report says how much was left out.
+type logLimit struct {
+	mu      sync.Mutex
+	max     int64
+	logged  int64
+	dropped int64
+}
+
+func newLogLimit(max int64) *logLimit {
+	return &logLimit{max: max}
+}
+
+// cut returns as much of the line as still fits, and false once nothing does
+func (l *logLimit) cut(line string) (string, bool) {
+	if l.max <= 0 {
+		return line, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	left := l.max - l.logged
+	if left <= 0 {
+		l.dropped += int64(len(line))
+		return "", false
+	}
+	if int64(len(line)) > left {
+		l.dropped += int64(len(line)) - left
+		line = line[:left]
+	}
+	l.logged += int64(len(line))
+	return line, true
+}
+
+func (l *logLimit) report() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.dropped > 0 {
+		log.Printf("Output: ...[truncated %d bytes]", l.dropped)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestLineBufferFlushWhileWriting flushes the buffer the way a fatal exit
+// does, from another goroutine while the session writes to it
+func TestLineBufferFlushWhileWriting(t *testing.T) {
+	var out bytes.Buffer
+	l := newLineBuffer(&lockedWriter{w: &out})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			l.Write([]byte("part "))
+			l.Write([]byte("line\n"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		l.Flush()
+	}
+	wg.Wait()
+	l.Flush()
+
+	if got, want := strings.Count(out.String(), "part"), 1000; got != want {
+		t.Errorf("got %d parts, want %d", got, want)
+	}
+}
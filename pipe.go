@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// pipeReader reads from a named pipe, opening it again whenever the writer
+// closes it, so one process after the other can send commands through it.
+type pipeReader struct {
+	path string
+	file *os.File
+}
+
+func newPipeReader(path string) (*pipeReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// A regular file would be read over and over again
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a named pipe, create it with mkfifo", path)
+	}
+
+	return &pipeReader{path: path}, nil
+}
+
+func (p *pipeReader) Read(b []byte) (int, error) {
+	for {
+		// Opening blocks until there is a writer
+		if p.file == nil {
+			file, err := os.Open(p.path)
+			if err != nil {
+				return 0, err
+			}
+			p.file = file
+		}
+
+		n, err := p.file.Read(b)
+		if err == io.EOF {
+			p.file.Close()
+			p.file = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
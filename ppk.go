@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+const puttyKeyPrefix = "PuTTY-User-Key-File-"
+
+// puttyKey is a private key in PuTTY's .ppk format, version 2 or 3.
+type puttyKey struct {
+	version     int
+	algorithm   string
+	encryption  string
+	comment     string
+	headers     map[string]string
+	publicBlob  []byte
+	privateBlob []byte
+	mac         []byte
+}
+
+func isPuttyKey(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(puttyKeyPrefix))
+}
+
+func parsePuttyKey(buf []byte, passphrase []byte) (ssh.Signer, error) {
+	key, err := readPuttyKey(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	private, macKey, err := key.decrypt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := key.verifyMac(private, macKey); err != nil {
+		return nil, err
+	}
+
+	return getPuttySigner(key.algorithm, key.publicBlob, private)
+}
+
+func readPuttyKey(buf []byte) (*puttyKey, error) {
+	lines := strings.Split(strings.ReplaceAll(string(buf), "\r\n", "\n"), "\n")
+	key := &puttyKey{headers: make(map[string]string)}
+
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == "" {
+			continue
+		}
+		parts := strings.SplitN(lines[i], ": ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line %d in the PuTTY key", i+1)
+		}
+		name, value := parts[0], parts[1]
+
+		switch {
+		case strings.HasPrefix(name, puttyKeyPrefix):
+			version, err := strconv.Atoi(strings.TrimPrefix(name, puttyKeyPrefix))
+			if err != nil || (version != 2 && version != 3) {
+				return nil, fmt.Errorf("unsupported PuTTY key format %q, only versions 2 and 3 are supported", name)
+			}
+			key.version = version
+			key.algorithm = value
+		case name == "Public-Lines" || name == "Private-Lines":
+			count, err := strconv.Atoi(value)
+			if err != nil || i+count >= len(lines) {
+				return nil, fmt.Errorf("invalid %s in the PuTTY key", name)
+			}
+			blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[i+1:i+1+count], ""))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s data in the PuTTY key: %w", name, err)
+			}
+			if name == "Public-Lines" {
+				key.publicBlob = blob
+			} else {
+				key.privateBlob = blob
+			}
+			i += count
+		default:
+			key.headers[name] = value
+		}
+	}
+
+	if key.version == 0 {
+		return nil, fmt.Errorf("missing PuTTY key header")
+	}
+	key.encryption = key.headers["Encryption"]
+	key.comment = key.headers["Comment"]
+
+	mac, err := hex.DecodeString(key.headers["Private-MAC"])
+	if err != nil || len(mac) == 0 {
+		return nil, fmt.Errorf("missing or invalid Private-MAC in the PuTTY key")
+	}
+	key.mac = mac
+
+	return key, nil
+}
+
+// decrypt returns the private blob in plain text and the key its MAC is
+// computed with.
+func (k *puttyKey) decrypt(passphrase []byte) ([]byte, []byte, error) {
+	switch k.encryption {
+	case "none":
+		if k.version == 2 {
+			return k.privateBlob, getPuttyV2MacKey(nil), nil
+		}
+		return k.privateBlob, nil, nil
+	case "aes256-cbc":
+	default:
+		return nil, nil, fmt.Errorf("unsupported PuTTY key encryption %q", k.encryption)
+	}
+
+	if len(passphrase) == 0 {
+		return nil, nil, fmt.Errorf("the PuTTY key is encrypted, but no privateKeyPassphrase is configured")
+	}
+	if len(k.privateBlob)%aes.BlockSize != 0 {
+		return nil, nil, fmt.Errorf("invalid length of the encrypted PuTTY key")
+	}
+
+	var cipherKey, iv, macKey []byte
+	if k.version == 2 {
+		cipherKey = append(getPuttyV2KeyHash(0, passphrase), getPuttyV2KeyHash(1, passphrase)...)[:32]
+		iv = make([]byte, aes.BlockSize)
+		macKey = getPuttyV2MacKey(passphrase)
+	} else {
+		derived, err := k.deriveV3Key(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+	}
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := make([]byte, len(k.privateBlob))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, k.privateBlob)
+
+	return private, macKey, nil
+}
+
+// deriveV3Key derives the 80 bytes of cipher key, IV and MAC key of format 3
+func (k *puttyKey) deriveV3Key(passphrase []byte) ([]byte, error) {
+	memory, err := strconv.ParseUint(k.headers["Argon2-Memory"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Argon2-Memory in the PuTTY key")
+	}
+	passes, err := strconv.ParseUint(k.headers["Argon2-Passes"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Argon2-Passes in the PuTTY key")
+	}
+	parallelism, err := strconv.ParseUint(k.headers["Argon2-Parallelism"], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Argon2-Parallelism in the PuTTY key")
+	}
+	salt, err := hex.DecodeString(k.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Argon2-Salt in the PuTTY key")
+	}
+
+	switch k.headers["Key-Derivation"] {
+	case "Argon2id":
+		return argon2.IDKey(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	case "Argon2i":
+		return argon2.Key(passphrase, salt, uint32(passes), uint32(memory), uint8(parallelism), 80), nil
+	}
+
+	return nil, fmt.Errorf("unsupported PuTTY key derivation %q", k.headers["Key-Derivation"])
+}
+
+func (k *puttyKey) verifyMac(private []byte, macKey []byte) error {
+	var h func() hash.Hash
+	if k.version == 2 {
+		h = sha1.New
+	} else {
+		h = sha256.New
+	}
+
+	mac := hmac.New(h, macKey)
+	for _, field := range [][]byte{[]byte(k.algorithm), []byte(k.encryption), []byte(k.comment), k.publicBlob, private} {
+		mac.Write(ssh.Marshal(struct{ Data []byte }{field}))
+	}
+
+	if !hmac.Equal(mac.Sum(nil), k.mac) {
+		if k.encryption == "none" {
+			return fmt.Errorf("the PuTTY key is corrupted (MAC mismatch)")
+		}
+		return fmt.Errorf("wrong passphrase for the PuTTY key (MAC mismatch)")
+	}
+
+	return nil
+}
+
+func getPuttyV2KeyHash(counter byte, passphrase []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte{0, 0, 0, counter})
+	h.Write(passphrase)
+	return h.Sum(nil)
+}
+
+func getPuttyV2MacKey(passphrase []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte("putty-private-key-file-mac-key"))
+	h.Write(passphrase)
+	return h.Sum(nil)
+}
+
+// getPuttySigner builds the key from the public and private blobs, which
+// hold the key parameters in SSH wire format. The private blob may carry
+// padding at the end.
+func getPuttySigner(algorithm string, public []byte, private []byte) (ssh.Signer, error) {
+	switch algorithm {
+	case ssh.KeyAlgoRSA:
+		var pub struct {
+			Name string
+			E    *big.Int
+			N    *big.Int
+		}
+		var priv struct {
+			D    *big.Int
+			P    *big.Int
+			Q    *big.Int
+			Iqmp *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPuttyBlobs(public, &pub, private, &priv); err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: pub.N, E: int(pub.E.Int64())},
+			D:         priv.D,
+			Primes:    []*big.Int{priv.P, priv.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid RSA key in the PuTTY key: %w", err)
+		}
+		key.Precompute()
+		return ssh.NewSignerFromKey(key)
+	case ssh.KeyAlgoED25519:
+		var pub struct {
+			Name string
+			Key  []byte
+		}
+		var priv struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPuttyBlobs(public, &pub, private, &priv); err != nil {
+			return nil, err
+		}
+		if len(priv.Key) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid Ed25519 key in the PuTTY key")
+		}
+		return ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(priv.Key))
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var pub struct {
+			Name  string
+			Curve string
+			Q     []byte
+		}
+		var priv struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := unmarshalPuttyBlobs(public, &pub, private, &priv); err != nil {
+			return nil, err
+		}
+		curve := map[string]elliptic.Curve{
+			"nistp256": elliptic.P256(),
+			"nistp384": elliptic.P384(),
+			"nistp521": elliptic.P521(),
+		}[pub.Curve]
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q in the PuTTY key", pub.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, pub.Q)
+		if x == nil {
+			return nil, fmt.Errorf("invalid ECDSA key in the PuTTY key")
+		}
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         priv.D,
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	return nil, fmt.Errorf("unsupported key algorithm %q in the PuTTY key", algorithm)
+}
+
+func unmarshalPuttyBlobs(public []byte, pub interface{}, private []byte, priv interface{}) error {
+	if err := ssh.Unmarshal(public, pub); err != nil {
+		return fmt.Errorf("invalid public key in the PuTTY key: %w", err)
+	}
+	if err := ssh.Unmarshal(private, priv); err != nil {
+		return fmt.Errorf("invalid private key in the PuTTY key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// promptWatcher waits for the shell prompt in the output, at the end of
+// what came after the last newline, since a prompt has none.
+type promptWatcher struct {
+	mu      sync.Mutex
+	pattern *regexp.Regexp
+	buf     []byte
+	seen    bool
+	ready   chan struct{}
+}
+
+func newPromptWatcher(pattern string) (*promptWatcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &promptWatcher{pattern: re, ready: make(chan struct{})}, nil
+}
+
+func (p *promptWatcher) watch(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.seen {
+		return
+	}
+
+	p.buf = append(p.buf, b...)
+	if i := bytes.LastIndexByte(p.buf, '\n'); i >= 0 {
+		p.buf = p.buf[i+1:]
+	}
+	if len(p.buf) > maxLineLength {
+		p.buf = p.buf[len(p.buf)-maxLineLength:]
+	}
+	if p.pattern.Match(p.buf) {
+		p.seen = true
+		p.buf = nil
+		close(p.ready)
+	}
+}
+
+// wait returns once the prompt showed up, or false after the timeout
+func (p *promptWatcher) wait(timeout time.Duration) bool {
+	select {
+	case <-p.ready:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxReconnectDelay caps the wait between reconnect attempts, which doubles
+// from a second after each one that fails.
+const maxReconnectDelay = 30 * time.Second
+
+// connectionCheckTimeout is how long isConnectionLost waits for the server
+// to answer before it takes the connection for lost.
+const connectionCheckTimeout = 10 * time.Second
+
+// isConnectionLost tells whether the connection of the client is gone, as
+// opposed to only the session, which the escape sequence closes for one
+func isConnectionLost(client *ssh.Client) bool {
+	return sendKeepAlive(client, connectionCheckTimeout) != nil
+}
+
+// reconnect connects again after the connection was lost, up to attempts
+// times and, with a deadline, only as long as the next attempt starts before
+// it passes. It returns the error of the last attempt when none succeed.
+func reconnect(connect func() (*ssh.Client, error), attempts int, deadline time.Duration) (*ssh.Client, error) {
+	start := time.Now()
+	delay := time.Second
+	err := errors.New("the retryDeadline passed before the first attempt")
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if deadline > 0 && time.Since(start)+delay > deadline {
+			log.Printf("Giving up reconnecting after %d of %d attempts, the retryDeadline of %s is reached", attempt-1, attempts, deadline)
+			return nil, err
+		}
+		time.Sleep(delay)
+		var client *ssh.Client
+		client, err = connect()
+		if err == nil {
+			return client, nil
+		}
+		log.Printf("Reconnect attempt %d of %d failed: %s", attempt, attempts, err)
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+
+	log.Printf("Giving up reconnecting after %s, all %d reconnectAttempts failed", time.Since(start).Round(time.Second), attempts)
+	return nil, err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// getRemoteScript returns the command running remoteScriptFile on the
+// remote, which is a bash reading the script from stdin, and the script.
+func getRemoteScript(configuration Configurations) (string, []byte, error) {
+	script, err := ioutil.ReadFile(configuration.RemoteScriptFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read remoteScriptFile at %s: %w", configuration.RemoteScriptFile, err)
+	}
+
+	command := getRemotePathPrefix(configuration) + "bash -s --"
+	for _, arg := range configuration.ScriptArgs {
+		command += " " + shellQuote(arg)
+	}
+
+	return command, script, nil
+}
+
+// getRemotePathPrefix returns the assignment putting remotePath in front of
+// the PATH of the remote, to go before a command, or nothing without one
+func getRemotePathPrefix(configuration Configurations) string {
+	if configuration.RemotePath == "" {
+		return ""
+	}
+	return "PATH=" + shellQuote(configuration.RemotePath) + `:"$PATH" `
+}
+
+// getShellCommand returns remoteCommand the way it is sent to a shell. A
+// POSIX shell gets it through eval, so it parses the command as one string
+// like sh -c does in exec mode: an unfinished quote or && is a syntax error
+// instead of the shell waiting for the rest of it in the input, and a
+// comment can't swallow the commandMarker behind it. There is no eval on
+// Windows, where the command is sent as it is.
+func getShellCommand(command string, serverVersion string) string {
+	if strings.Contains(serverVersion, "Windows") {
+		return command
+	}
+	return "eval " + shellQuote(command)
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
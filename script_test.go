@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+var remoteCommands = []string{
+	"uci",
+	"cd /opt/engines && ./stockfish",
+	`echo "two  spaces"`,
+	`echo 'single quoted $HOME'`,
+	`echo it's`,
+	`echo "it's" 'say "hi"'`,
+	`engine=stockfish; echo $engine ${engine}x "$engine"`,
+	`false && echo left || echo right`,
+	`echo one; echo two # comment`,
+	`exit 3`,
+}
+
+func TestGetShellCommand(t *testing.T) {
+	tests := []struct {
+		command       string
+		serverVersion string
+		want          string
+	}{
+		{"uci", "SSH-2.0-OpenSSH_8.9p1", `eval 'uci'`},
+		{"cd /opt && ./stockfish", "SSH-2.0-OpenSSH_8.9p1", `eval 'cd /opt && ./stockfish'`},
+		{`echo "$HOME"`, "SSH-2.0-OpenSSH_8.9p1", `eval 'echo "$HOME"'`},
+		{`echo 'it'`, "SSH-2.0-OpenSSH_8.9p1", `eval 'echo '\''it'\'''`},
+		{`cd C:\engines && stockfish.exe`, "SSH-2.0-OpenSSH_for_Windows_8.1", `cd C:\engines && stockfish.exe`},
+	}
+
+	for _, test := range tests {
+		if got := getShellCommand(test.command, test.serverVersion); got != test.want {
+			t.Errorf("getShellCommand(%q, %q) = %q, want %q", test.command, test.serverVersion, got, test.want)
+		}
+	}
+}
+
+// TestShellCommandLikeExec runs each remoteCommand the two ways it reaches
+// a POSIX shell: as the command of the session, which sshd runs with sh -c,
+// and sent to the shell reading its input. Both have to agree.
+func TestShellCommandLikeExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell to run the commands")
+	}
+
+	for _, command := range remoteCommands {
+		t.Run(command, func(t *testing.T) {
+			execOutput, execCode := runShell(t, exec.Command("sh", "-c", command), "")
+			shellOutput, shellCode := runShell(t, exec.Command("sh"), getShellCommand(command, "SSH-2.0-OpenSSH_8.9p1")+"\n")
+			if shellOutput != execOutput || shellCode != execCode {
+				t.Errorf("sent to a shell it printed %q and exited with %d, as the command %q and %d", shellOutput, shellCode, execOutput, execCode)
+			}
+		})
+	}
+}
+
+func runShell(t *testing.T, cmd *exec.Cmd, input string) (string, int) {
+	t.Helper()
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(output), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), 0
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errCommandNotAllowed = errors.New("command not allowed")
+	errStdinClosed       = errors.New("the remote closed its input")
+)
+
+// commandSender sends command lines to the remote shell, refusing the ones
+// not on the allowlist. When there is an audit log, every line sent is
+// recorded in it.
+type commandSender struct {
+	stdin   io.Writer
+	allowed []*regexp.Regexp
+	audit   *auditLog
+	marker  *commandMarker
+	echo    *commandEcho
+	newline string
+	// conditional lets the lines carry a when clause, as the lines of a
+	// command file can
+	conditional bool
+}
+
+// newCommandSender compiles the allowedCommands entries. Entries between
+// slashes are regular expressions, others are exact commands. Either has to
+// match the whole line. Without entries everything is allowed.
+func newCommandSender(stdin io.Writer, allowedCommands []string) (*commandSender, error) {
+	sender := &commandSender{stdin: stdin, newline: "\n"}
+	for _, entry := range allowedCommands {
+		pattern := regexp.QuoteMeta(entry)
+		if len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			pattern = entry[1 : len(entry)-1]
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedCommands entry %q: %w", entry, err)
+		}
+		sender.allowed = append(sender.allowed, re)
+	}
+
+	return sender, nil
+}
+
+func (s *commandSender) isAllowed(line string) bool {
+	if len(s.allowed) == 0 {
+		return true
+	}
+	for _, re := range s.allowed {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *commandSender) send(line string) error {
+	if s.conditional {
+		condition, command, err := parseCommandCondition(line)
+		if err != nil {
+			return err
+		}
+		if condition != nil {
+			return s.sendIf(condition, command, command)
+		}
+	}
+	return s.sendCommand(line, line)
+}
+
+// sendCommand is send with another command going to the shell than the
+// line that is checked, echoed and recorded
+func (s *commandSender) sendCommand(line string, command string) error {
+	return s.sendIf(nil, line, command)
+}
+
+// sendIf is sendCommand for a command with a when clause, which is only
+// sent if the clause holds for the command before. That takes a marker to
+// tell how the command before did.
+func (s *commandSender) sendIf(condition *commandCondition, line string, command string) error {
+	if !s.isAllowed(line) {
+		return fmt.Errorf("%w: %s", errCommandNotAllowed, line)
+	}
+
+	if s.marker != nil {
+		prev, finished := s.marker.wait()
+		if condition != nil && !condition.holds(prev, finished) {
+			s.marker.skip(line, condition)
+			return nil
+		}
+		s.marker.start(line)
+	}
+	if s.echo != nil {
+		if err := s.echo.echo(line); err != nil {
+			return err
+		}
+	}
+	if s.marker != nil {
+		return s.writeCommand(line, command+s.marker.suffix())
+	}
+	return s.writeCommand(line, command)
+}
+
+// start runs the line as the command of the session, instead of sending it
+// to a shell, with the same checks and records as send. The command run may
+// carry more than the line.
+func (s *commandSender) start(session *ssh.Session, line string, command string) error {
+	if !s.isAllowed(line) {
+		return fmt.Errorf("%w: %s", errCommandNotAllowed, line)
+	}
+	if s.echo != nil {
+		if err := s.echo.echo(line); err != nil {
+			return err
+		}
+	}
+	// Nothing is run that isn't in the audit log first
+	if err := s.record(line); err != nil {
+		return err
+	}
+	return session.Start(command)
+}
+
+// write sends a line without checking the allowlist, for lines that come
+// from the configuration rather than the user.
+func (s *commandSender) write(line string) error {
+	return s.writeCommand(line, line)
+}
+
+// writeCommand sends the command as sent, which may carry more than the
+// line recorded. The line is recorded before it is sent, so nothing is run
+// that isn't in the audit log. The stdin pipe of the session doesn't buffer,
+// so the line goes out in one piece right away.
+func (s *commandSender) writeCommand(line string, sent string) error {
+	if err := s.record(line); err != nil {
+		return err
+	}
+
+	buf := []byte(sent + s.newline)
+	n, err := s.stdin.Write(buf)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+		return fmt.Errorf("%w: %v", errStdinClosed, err)
+	}
+	return err
+}
+
+func (s *commandSender) record(command string) error {
+	if s.audit == nil {
+		return nil
+	}
+	return s.audit.record(command)
+}
+
+// getLineEnding returns what the lines sent end with, as lineEnding says.
+// For auto that is CRLF for the Windows port of OpenSSH, which tells in its
+// version, and LF for any other server.
+func getLineEnding(lineEnding string, serverVersion string) string {
+	switch lineEnding {
+	case "crlf":
+		return "\r\n"
+	case "auto":
+		if strings.Contains(serverVersion, "Windows") {
+			return "\r\n"
+		}
+	}
+	return "\n"
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardSignals relays the named local signals to the remote session
+// instead of acting on them locally, until the returned stop is called.
+func forwardSignals(session *ssh.Session, names []string) (func(), error) {
+	signals := make(map[os.Signal]ssh.Signal)
+	for _, name := range names {
+		name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+		sig, ok := forwardableSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("signal %s can't be forwarded on this platform", name)
+		}
+		signals[sig] = ssh.Signal(name)
+	}
+	if len(signals) == 0 {
+		return func() {}, nil
+	}
+
+	ch := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(ch, sig)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				if err := session.Signal(signals[sig]); err != nil {
+					log.Printf("Could not forward signal %s: %s", signals[sig], err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// A retried session gets its own, the signals act locally again until then
+	stop := func() {
+		signal.Stop(ch)
+		close(done)
+	}
+	return stop, nil
+}
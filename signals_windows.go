@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// forwardableSignals maps the SSH signal names to the local signals. The
+// console only knows Ctrl-C and being closed.
+var forwardableSignals = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"TERM": syscall.SIGTERM,
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// sshfpTimeout bounds each DNS query for SSHFP records
+const sshfpTimeout = 5 * time.Second
+
+// typeSSHFP is the DNS record type of SSHFP records (RFC 4255), which the
+// dnsmessage package doesn't know by name
+const typeSSHFP dnsmessage.Type = 44
+
+// sshfpAlgorithms are the SSHFP algorithm numbers of the host key types
+var sshfpAlgorithms = map[string]byte{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+// sshfpRecord is an SSHFP record: the algorithm of the key, the type of
+// the fingerprint (1 for SHA-1, 2 for SHA-256) and the fingerprint itself
+type sshfpRecord struct {
+	algorithm   byte
+	hashType    byte
+	fingerprint []byte
+}
+
+// getSshfpCallback trusts the host keys that match an SSHFP record of the
+// host, like OpenSSH's VerifyHostKeyDNS. Only answers the DNS server marks
+// as validated with DNSSEC count, as anyone on the path could forge the
+// others. Any other outcome leaves the decision to next.
+func getSshfpCallback(configuration Configurations, next ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			host = hostname
+		}
+		if net.ParseIP(host) != nil {
+			if debugLogging {
+				log.Printf("Not looking up SSHFP records for %s, it is an IP address", host)
+			}
+			return next(hostname, remote, key)
+		}
+
+		records, secure, err := lookupSshfp(configuration.DnsServer, host)
+		switch {
+		case err != nil:
+			log.Printf("Could not look up the SSHFP records of %s: %s", host, err)
+		case len(records) == 0:
+			if debugLogging {
+				log.Printf("No SSHFP records for %s", host)
+			}
+		case !matchesSshfp(records, key):
+			log.Printf("None of the SSHFP records of %s match its host key %s %s", host, key.Type(), getFingerprint(key, configuration.FingerprintHash))
+		case !secure:
+			log.Printf("The host key of %s matches an SSHFP record, but the answer isn't validated with DNSSEC", host)
+		default:
+			if debugLogging {
+				log.Printf("The host key of %s matches a DNSSEC validated SSHFP record", host)
+			}
+			return nil
+		}
+
+		return next(hostname, remote, key)
+	}
+}
+
+// matchesSshfp tells whether one of the records is the fingerprint of key
+func matchesSshfp(records []sshfpRecord, key ssh.PublicKey) bool {
+	algorithm, ok := sshfpAlgorithms[key.Type()]
+	if !ok {
+		return false
+	}
+	sha1Sum := sha1.Sum(key.Marshal())
+	sha256Sum := sha256.Sum256(key.Marshal())
+
+	for _, record := range records {
+		if record.algorithm != algorithm {
+			continue
+		}
+		if record.hashType == 1 && bytes.Equal(record.fingerprint, sha1Sum[:]) {
+			return true
+		}
+		if record.hashType == 2 && bytes.Equal(record.fingerprint, sha256Sum[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupSshfp asks the DNS server for the SSHFP records of host, and
+// whether the server validated them with DNSSEC. The host is looked up as
+// given, without search domains.
+func lookupSshfp(server string, host string) ([]sshfpRecord, bool, error) {
+	server, err := getDnsServer(server)
+	if err != nil {
+		return nil, false, err
+	}
+	query, id, err := buildSshfpQuery(host)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := exchangeDns("udp", server, query)
+	if err != nil {
+		return nil, false, err
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, false, err
+	}
+	// Too many records for a datagram are sent again over TCP
+	if header.Truncated {
+		if response, err = exchangeDns("tcp", server, query); err != nil {
+			return nil, false, err
+		}
+		if header, err = parser.Start(response); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if header.ID != id {
+		return nil, false, errors.New("the DNS answer is for another query")
+	}
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, false, nil
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, false, fmt.Errorf("the DNS server answered %s", header.RCode)
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, false, err
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return nil, false, err
+	}
+	var records []sshfpRecord
+	for _, answer := range answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || answer.Header.Type != typeSSHFP || len(body.Data) < 3 {
+			continue
+		}
+		records = append(records, sshfpRecord{algorithm: body.Data[0], hashType: body.Data[1], fingerprint: body.Data[2:]})
+	}
+
+	return records, header.AuthenticData, nil
+}
+
+// buildSshfpQuery builds the query for the SSHFP records of host. It asks
+// for the DNSSEC status of the answer, with the AD bit and EDNS0's DO bit.
+func buildSshfpQuery(host string) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+
+	header := dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true, AuthenticData: true}
+	builder := dnsmessage.NewBuilder(nil, header)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: typeSSHFP, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, 0, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	query, err := builder.Finish()
+
+	return query, header.ID, err
+}
+
+// exchangeDns sends the query to the server and returns its answer. Over
+// TCP, messages go with their length in front.
+func exchangeDns(network string, server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, sshfpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sshfpTimeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, 65535)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:n], nil
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(query)))
+	if _, err := conn.Write(append(length, query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// getDnsServer returns the address of the DNS server: the configured one,
+// or the first nameserver of /etc/resolv.conf. Port 53 is the default.
+func getDnsServer(server string) (string, error) {
+	if server == "" {
+		file, err := os.Open("/etc/resolv.conf")
+		if err != nil {
+			return "", fmt.Errorf("no dnsServer set, and %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+		if server == "" {
+			return "", errors.New("no dnsServer set, and no nameserver in /etc/resolv.conf")
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	return server, nil
+}
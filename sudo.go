@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var sudoPromptPattern = regexp.MustCompile(`\[sudo\] password for`)
+
+// sudoResponder answers the sudo password prompt in the remote output, once.
+// The password is written to stdin directly, not through the commandSender,
+// so it never ends up in the audit log or the debug log. A second prompt
+// means the password was wrong, and rather than answering it again,
+// onFailure is called. So is it for a prompt after the timeout, and when
+// the password can't be sent. The password ends with newline, the line
+// ending the server expects.
+type sudoResponder struct {
+	mu        sync.Mutex
+	stdin     io.Writer
+	password  string
+	newline   string
+	timeout   time.Duration
+	deadline  time.Time
+	timer     *time.Timer
+	answered  bool
+	finished  bool
+	buf       []byte
+	onFailure func(category error, reason string)
+	done      chan struct{}
+}
+
+func newSudoResponder(stdin io.Writer, password string, newline string, timeout time.Duration, onFailure func(category error, reason string)) *sudoResponder {
+	return &sudoResponder{
+		stdin:     stdin,
+		password:  password,
+		newline:   newline,
+		timeout:   timeout,
+		onFailure: onFailure,
+		done:      make(chan struct{}),
+	}
+}
+
+// start starts the timeout. The done channel is closed once the prompt is
+// answered, or when there is no point in waiting for it anymore. Without a
+// timeout a prompt is answered whenever it shows up, but stdin isn't held
+// open for it, so done is closed right away.
+func (s *sudoResponder) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timeout <= 0 {
+		s.finish()
+		return
+	}
+	s.deadline = time.Now().Add(s.timeout)
+	s.timer = time.AfterFunc(s.timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finish()
+	})
+}
+
+// stop closes the done channel once the session is over, whether the
+// prompt showed up or not
+func (s *sudoResponder) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.finish()
+}
+
+func (s *sudoResponder) finish() {
+	if !s.finished {
+		s.finished = true
+		close(s.done)
+	}
+}
+
+func (s *sudoResponder) watch(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = append(s.buf, p...)
+	for {
+		match := sudoPromptPattern.FindIndex(s.buf)
+		if match == nil {
+			break
+		}
+		s.buf = s.buf[match[1]:]
+
+		switch {
+		case s.answered:
+			s.onFailure(errAuth, "sudo asked for the password again, sudoPassword is probably wrong")
+		case !s.deadline.IsZero() && time.Now().After(s.deadline):
+			s.onFailure(errAuth, "sudo asked for the password after sudoPromptTimeout")
+		default:
+			if _, err := io.WriteString(s.stdin, s.password+s.newline); err != nil {
+				s.onFailure(errNetwork, fmt.Sprintf("Could not send the sudo password: %s", err))
+			}
+			s.answered = true
+		}
+		s.finish()
+	}
+	if len(s.buf) > maxLineLength {
+		s.buf = s.buf[len(s.buf)-maxLineLength:]
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// SyncDir is a local directory mirrored to the remote
+type SyncDir struct {
+	Local  string `mapstructure:"local"`
+	Remote string `mapstructure:"remote"`
+	Delete bool   `mapstructure:"delete"`
+}
+
+// getSyncChanges compares the local directory with the remote one. A file
+// is uploaded when it is missing on the remote, or its size or modification
+// time differ. With delete, the remote files and directories that aren't
+// there locally are returned as stale, the deepest first.
+func getSyncChanges(client *sftp.Client, dir SyncDir) ([]Transfer, []string, error) {
+	// The remote walk starts at the directory as given, a trailing slash
+	// and all, the paths of the local files are clean
+	dir.Remote = path.Clean(dir.Remote)
+
+	var uploads []Transfer
+	local := make(map[string]bool)
+
+	err := filepath.Walk(dir.Local, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir.Local, file)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(dir.Remote, filepath.ToSlash(rel))
+		local[remote] = true
+
+		// Links and such are left out, like empty directories
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// SFTP only keeps whole seconds
+		remoteInfo, err := client.Stat(remote)
+		if err == nil && remoteInfo.Size() == info.Size() && remoteInfo.ModTime().Equal(info.ModTime().Truncate(time.Second)) {
+			return nil
+		}
+		uploads = append(uploads, Transfer{Local: file, Remote: remote})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the sync directory: %w", err)
+	}
+
+	if !dir.Delete {
+		return uploads, nil, nil
+	}
+	if _, err := client.Stat(dir.Remote); errors.Is(err, os.ErrNotExist) {
+		return uploads, nil, nil
+	}
+
+	var stale []string
+	walker := client.Walk(dir.Remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, nil, fmt.Errorf("could not read the remote sync directory: %w", err)
+		}
+		if !local[walker.Path()] {
+			stale = append(stale, walker.Path())
+		}
+	}
+
+	// Parents are walked before their contents
+	for i, j := 0, len(stale)-1; i < j; i, j = i+1, j-1 {
+		stale[i], stale[j] = stale[j], stale[i]
+	}
+
+	return uploads, stale, nil
+}
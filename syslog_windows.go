@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog fails, Windows has no syslog
+func openSyslog(facility string, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+func isTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// readTerminalLine shows the prompt on stderr and reads a line typed on the
+// terminal, without showing it unless echo is set. The line is read a byte
+// at a time, so whatever follows it, like pasted input or the first line of
+// the chess GUI, is left on stdin for the session.
+func readTerminalLine(prompt string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if !echo {
+		line, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(line), err
+	}
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				break
+			}
+			return string(line), err
+		}
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// requestPty asks for a remote PTY with the type and size of the local
+// terminal. Without echo the PTY doesn't repeat the input it receives.
+func requestPty(session *ssh.Session, echo bool) error {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm"
+	}
+
+	var echoMode uint32
+	if echo {
+		echoMode = 1
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          echoMode,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+
+	return session.RequestPty(termType, height, width, modes)
+}
+
+// makeTerminalRaw puts the local terminal in raw mode, so keys go to the
+// remote PTY untouched, and makes it render the remote escape sequences.
+// The returned function restores the previous state.
+func makeTerminalRaw() (func(), error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreOutput, err := enableVirtualTerminal()
+	if err != nil {
+		term.Restore(fd, state)
+		return nil, err
+	}
+
+	return func() {
+		restoreOutput()
+		term.Restore(fd, state)
+	}, nil
+}
+
+var (
+	terminalInput     chan []byte
+	terminalInputOnce sync.Once
+)
+
+// copyTerminalInput copies the keys typed on the local terminal to w until
+// the terminal is closed, writing to w fails or done is closed. The keys are
+// read on a goroutine of their own that outlives the session, so a session
+// after a reconnect gets them all, and none are lost to the previous one.
+func copyTerminalInput(w io.Writer, done <-chan struct{}) {
+	terminalInputOnce.Do(func() {
+		terminalInput = make(chan []byte)
+		go func() {
+			for {
+				buf := make([]byte, 1024)
+				n, err := os.Stdin.Read(buf)
+				if n > 0 {
+					terminalInput <- buf[:n]
+				}
+				if err != nil {
+					close(terminalInput)
+					return
+				}
+			}
+		}()
+	})
+
+	for {
+		select {
+		case keys, ok := <-terminalInput:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(keys); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// enableVirtualTerminal is only needed for the Windows console, other
+// terminals handle VT escape sequences already.
+func enableVirtualTerminal() (func(), error) {
+	return func() {}, nil
+}
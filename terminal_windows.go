@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// enableVirtualTerminal makes the console interpret the VT escape sequences
+// sent by the remote PTY, which it doesn't do by default. Output that isn't
+// a console, like a file or a pipe, is left alone. The returned function
+// restores the previous console mode.
+func enableVirtualTerminal() (func(), error) {
+	handle := windows.Handle(os.Stdout.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return func() {}, nil
+	}
+	if err := windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		windows.SetConsoleMode(handle, mode)
+	}, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// traceLogging is on with traceSsh, for diagnosing handshakes
+var traceLogging bool
+
+func tracef(format string, args ...interface{}) {
+	if traceLogging {
+		log.Printf("Trace: "+format, args...)
+	}
+}
+
+// traceKexInit logs the algorithms both sides offered, which is what a
+// failed negotiation comes down to.
+func traceKexInit(conn *kexInitConn) {
+	if version := conn.server.getVersion(); version != "" {
+		tracef("Server version %s", version)
+	}
+
+	for _, side := range []struct {
+		name string
+		msg  *kexInitMsg
+	}{{"Client", conn.client.get()}, {"Server", conn.server.get()}} {
+		if side.msg == nil {
+			tracef("%s sent no KEXINIT", side.name)
+			continue
+		}
+		tracef("%s offers kex %s", side.name, strings.Join(side.msg.KexAlgos, ","))
+		tracef("%s offers host key algorithms %s", side.name, strings.Join(side.msg.ServerHostKeyAlgos, ","))
+		tracef("%s offers ciphers %s", side.name, strings.Join(side.msg.CiphersClientServer, ","))
+		tracef("%s offers MACs %s", side.name, strings.Join(side.msg.MACsClientServer, ","))
+	}
+}
+
+// traceSigners logs the keys offered to the server, and the ones it
+// accepted, which are the ones asked to sign.
+func traceSigners(getSigners func() ([]ssh.Signer, error), hash string) func() ([]ssh.Signer, error) {
+	if !traceLogging {
+		return getSigners
+	}
+
+	return func() ([]ssh.Signer, error) {
+		signers, err := getSigners()
+		if err != nil {
+			tracef("Could not get the keys to offer: %s", err)
+			return nil, err
+		}
+
+		traced := make([]ssh.Signer, len(signers))
+		for i, signer := range signers {
+			key := signer.PublicKey()
+			tracef("Offering key %s %s", key.Type(), getFingerprint(key, hash))
+			// RSA keys only sign with SHA-2 through AlgorithmSigner
+			if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+				traced[i] = tracingAlgorithmSigner{algorithmSigner, hash}
+			} else {
+				traced[i] = tracingSigner{signer, hash}
+			}
+		}
+		return traced, nil
+	}
+}
+
+type tracingSigner struct {
+	ssh.Signer
+	hash string
+}
+
+func (s tracingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	traceSignature(s.PublicKey(), "", s.hash)
+	return s.Signer.Sign(rand, data)
+}
+
+type tracingAlgorithmSigner struct {
+	ssh.AlgorithmSigner
+	hash string
+}
+
+func (s tracingAlgorithmSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	traceSignature(s.PublicKey(), "", s.hash)
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s tracingAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	traceSignature(s.PublicKey(), algorithm, s.hash)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func traceSignature(key ssh.PublicKey, algorithm string, hash string) {
+	if algorithm == "" {
+		algorithm = key.Type()
+	}
+	tracef("Server accepts key %s, signing with %s", getFingerprint(key, hash), algorithm)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer is a file copied between the local and the remote side. An
+// upload can be given another owner and group on the remote.
+type Transfer struct {
+	Local  string `mapstructure:"local"`
+	Remote string `mapstructure:"remote"`
+	Owner  string `mapstructure:"owner"`
+	Group  string `mapstructure:"group"`
+}
+
+type transferJob struct {
+	upload bool
+	Transfer
+}
+
+// transferProgress adds up the transfers of all workers, for the log
+type transferProgress struct {
+	mu    sync.Mutex
+	total int
+	done  int
+	bytes int64
+}
+
+func (p *transferProgress) add(job transferJob, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	p.bytes += n
+	direction := "Downloaded " + job.Remote + " to " + job.Local
+	if job.upload {
+		direction = "Uploaded " + job.Local + " to " + job.Remote
+	}
+	log.Printf("%s (%d of %d files, %d bytes in total)", direction, p.done, p.total, p.bytes)
+}
+
+// runTransfers copies the uploads and downloads over SFTP, and mirrors the
+// sync directory, at most transferConcurrency files at a time. It stops at
+// the first error.
+func runTransfers(client *ssh.Client, configuration Configurations) error {
+	var jobs []transferJob
+	for _, t := range configuration.Uploads {
+		jobs = append(jobs, transferJob{upload: true, Transfer: t})
+	}
+	for _, t := range configuration.Downloads {
+		jobs = append(jobs, transferJob{Transfer: t})
+	}
+	dir := configuration.SyncDir
+	if len(jobs) == 0 && dir.Local == "" {
+		return nil
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("could not start SFTP: %w", err)
+	}
+	defer sftpClient.Close()
+
+	var stale []string
+	if dir.Local != "" {
+		var uploads []Transfer
+		uploads, stale, err = getSyncChanges(sftpClient, dir)
+		if err != nil {
+			return err
+		}
+		for _, t := range uploads {
+			jobs = append(jobs, transferJob{upload: true, Transfer: t})
+		}
+		log.Printf("Syncing %s to %s: %d files to upload, %d to delete", dir.Local, dir.Remote, len(uploads), len(stale))
+	}
+
+	if err := copyFiles(sftpClient, jobs, configuration.TransferConcurrency); err != nil {
+		return err
+	}
+	if err := chownUploads(client, configuration.Uploads, configuration.SudoPassword); err != nil {
+		return err
+	}
+
+	// Only once everything is up to date, so a failed sync loses nothing
+	for _, remote := range stale {
+		if err := sftpClient.Remove(remote); err != nil {
+			return fmt.Errorf("could not delete %s on the remote: %w", remote, err)
+		}
+	}
+
+	return nil
+}
+
+// chownUploads gives the uploads with an owner or group these. SFTP only
+// takes numeric IDs, so chown is run on the remote instead. Where only root
+// may do that, chown is run again with sudo, which gets the sudoPassword
+// when there is one.
+func chownUploads(client *ssh.Client, uploads []Transfer, sudoPassword string) error {
+	for _, t := range uploads {
+		if t.Owner == "" && t.Group == "" {
+			continue
+		}
+		owner := t.Owner
+		if t.Group != "" {
+			owner += ":" + t.Group
+		}
+
+		command := "chown " + shellQuote(owner) + " -- " + shellQuote(t.Remote)
+		output, err := runRemoteCommand(client, command, "")
+		if err != nil {
+			sudo := "sudo -n "
+			input := ""
+			if sudoPassword != "" {
+				sudo, input = "sudo -S -p '' ", sudoPassword+"\n"
+			}
+			sudoOutput, sudoErr := runRemoteCommand(client, sudo+command, input)
+			if sudoErr != nil {
+				return fmt.Errorf("could not change the owner of %s to %s: %w: %s, and with sudo: %s", t.Remote, owner, err, strings.TrimSpace(output), strings.TrimSpace(sudoOutput))
+			}
+		}
+		log.Printf("Changed the owner of %s to %s", t.Remote, owner)
+	}
+
+	return nil
+}
+
+// runRemoteCommand runs the command in a session of its own, with input on
+// its stdin, and returns what it printed
+func runRemoteCommand(client *ssh.Client, command string, input string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("could not create a session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(input)
+	output, err := session.CombinedOutput(command)
+	return string(output), err
+}
+
+// copyFiles runs the jobs on concurrency workers. Once a job fails no more
+// are handed out, the ones under way are finished, and the first error is
+// returned.
+func copyFiles(sftpClient *sftp.Client, jobs []transferJob, concurrency int) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	progress := &transferProgress{total: len(jobs)}
+	queue := make(chan transferJob)
+	failed := make(chan struct{})
+	var firstErr error
+	var once sync.Once
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				var n int64
+				var err error
+				if job.upload {
+					n, err = uploadFile(sftpClient, job.Local, job.Remote)
+				} else {
+					n, err = downloadFile(sftpClient, job.Remote, job.Local)
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+					continue
+				}
+				progress.add(job, n)
+			}
+		}()
+	}
+handOut:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-failed:
+			break handOut
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
+
+// uploadFile copies the local file to the remote path, creating its
+// directory, and gives it the permissions and modification time of the
+// local file.
+func uploadFile(client *sftp.Client, local string, remote string) (int64, error) {
+	src, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return 0, fmt.Errorf("could not create the remote directory of %s: %w", remote, err)
+	}
+	dst, err := client.Create(remote)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s on the remote: %w", remote, err)
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, fmt.Errorf("could not upload %s: %w", local, err)
+	}
+	if err := dst.Chmod(info.Mode().Perm()); err != nil {
+		return n, err
+	}
+
+	// Keeping the modification time tells a synced file is up to date
+	return n, client.Chtimes(remote, info.ModTime(), info.ModTime())
+}
+
+// downloadFile copies the remote file to the local path, creating its
+// directory.
+func downloadFile(client *sftp.Client, remote string, local string) (int64, error) {
+	src, err := client.Open(remote)
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s on the remote: %w", remote, err)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return 0, err
+	}
+	dst, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, fmt.Errorf("could not download %s: %w", remote, err)
+	}
+
+	return n, nil
+}
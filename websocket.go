@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// wsConn carries the SSH stream in the binary messages of a WebSocket,
+// where message boundaries mean nothing.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// dialWebSocket connects to the SSH server tunnelled through the WebSocket
+// at wsURL, for servers that are only reachable over HTTP(S).
+func dialWebSocket(wsURL string, netDialer *net.Dialer, sshConfig *clientConfig) (*ssh.Client, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocketURL: %w", err)
+	}
+
+	dialer := websocket.Dialer{
+		NetDial:          netDialer.Dial,
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: sshConfig.Timeout,
+	}
+	conn, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the WebSocket %s: %w", u.Redacted(), err)
+	}
+
+	// The host key is checked against the host of the URL, there is no
+	// other name for the server
+	return newClientFromConn(&wsConn{Conn: conn}, getWebSocketAddress(u), sshConfig)
+}
+
+// getWebSocketAddress returns the host and port of the URL, with the port of
+// the scheme when there is none, as known_hosts entries need one
+func getWebSocketAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" || u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}